@@ -1,51 +1,46 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-	"strings"
 
-	"github.com/poy/cf-space-security/internal/capi"
-	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/sidecar"
+	"github.com/poy/cf-space-security/internal/transport"
 )
 
 func main() {
-	log := log.New(os.Stderr, "[REVERSE-PROXY] ", log.LstdFlags)
-	log.Println("starting cf-space-security reverse proxy...")
-	defer log.Println("closing cf-space-security reverse proxy...")
-
-	cfg := LoadConfig(log)
-
-	validator := capi.NewValidator(
-		cfg.VcapApplication.ApplicationID,
-		strings.Replace(cfg.VcapApplication.CAPIAddr, "https", "http", 1),
-		http.DefaultClient,
-		log,
-	)
-
-	u, err := url.Parse(fmt.Sprintf("http://localhost:%d", cfg.BackendPort))
-	if err != nil {
-		log.Fatalf("failed to parse backend addr: %s", err)
+	log := logger.New(os.Stderr, "REVERSE-PROXY", logger.Info, logger.Text)
+	cfg := sidecar.LoadReverseProxyConfig(log)
+	log = logger.New(os.Stderr, "REVERSE-PROXY", cfg.LogLevel, cfg.LogFormat)
+
+	log.Infof("starting cf-space-security reverse proxy...")
+	defer log.Infof("closing cf-space-security reverse proxy...")
+
+	s := sidecar.New(sidecar.Config{
+		Name:       "reverse-proxy",
+		ExpvarName: "ReverseProxy",
+		Client: transport.NewClient(transport.Config{
+			DialTimeout:           cfg.ClientDialTimeout,
+			TLSHandshakeTimeout:   cfg.ClientTLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.ClientResponseHeaderTimeout,
+		}, cfg.ClientTimeout),
+		CAPIAddr:                cfg.VcapApplication.CAPIAddr,
+		UAAAddr:                 cfg.UAAAddr,
+		HealthTimeout:           cfg.ClientTimeout,
+		LoggregatorIngressURL:   cfg.LoggregatorIngressURL,
+		LoggregatorEmitInterval: cfg.LoggregatorEmitInterval,
+		SourceID:                cfg.VcapApplication.ApplicationID,
+		InstanceIndex:           cfg.InstanceIndex,
+		OTLPAddr:                cfg.OTLPAddr,
+		OTLPFlushInterval:       cfg.OTLPFlushInterval,
+		ServerReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		ServerReadTimeout:       cfg.ServerReadTimeout,
+		ServerWriteTimeout:      cfg.ServerWriteTimeout,
+		ServerIdleTimeout:       cfg.ServerIdleTimeout,
+	}, log)
+
+	servers := sidecar.NewReverseProxy(cfg, s)
+	if err := s.Serve(cfg.HealthPort, cfg.ShutdownGracePeriod, servers...); err != nil {
+		log.Fatalf("failed to serve: %s", err)
 	}
-
-	rp := httputil.NewSingleHostReverseProxy(u)
-	rp.ErrorLog = log
-	revProxy := handlers.NewReverseProxy(rp, validator)
-	controller := handlers.NewController(
-		cfg.OpenEndpoints,
-		httputil.NewSingleHostReverseProxy(u),
-		revProxy,
-	)
-
-	log.Printf("Listening on %d", cfg.Port)
-	log.Fatalf("failed to serve: %s",
-		http.ListenAndServe(
-			fmt.Sprintf(":%d", cfg.Port),
-			controller,
-		),
-	)
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"code.cloudfoundry.org/go-envstruct"
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Config is what the sidecar adds to the proxy's and reverse proxy's
+// configs. PORT belongs to the reverse proxy, so the proxy listens on
+// ProxyPort and/or PROXY_SOCKET.
+type Config struct {
+	HealthPort int `env:"HEALTH_PORT, report"`
+	ProxyPort  int `env:"PROXY_PORT, report"`
+}
+
+func LoadConfig(log logger.Logger) Config {
+	cfg := Config{
+		HealthPort: 8081,
+	}
+	if err := envstruct.Load(&cfg); err != nil {
+		log.Fatalf("failed to load config: %s", err)
+	}
+
+	envstruct.WriteReport(&cfg)
+
+	return cfg
+}
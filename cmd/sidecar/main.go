@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/sidecar"
+	"github.com/poy/cf-space-security/internal/transport"
+)
+
+func main() {
+	log := logger.New(os.Stderr, "SIDECAR", logger.Info, logger.Text)
+	cfg := LoadConfig(log)
+	proxyCfg := sidecar.LoadProxyConfig(log)
+	reverseProxyCfg := sidecar.LoadReverseProxyConfig(log)
+	log = logger.New(os.Stderr, "SIDECAR", reverseProxyCfg.LogLevel, reverseProxyCfg.LogFormat)
+
+	proxyCfg.Port = cfg.ProxyPort
+	if proxyCfg.Port == 0 && proxyCfg.Socket == "" {
+		log.Fatalf("failed to load config: PROXY_PORT or PROXY_SOCKET is required")
+	}
+
+	log.Infof("starting cf-space-security sidecar...")
+	defer log.Infof("closing cf-space-security sidecar...")
+
+	// Both components share the client, metrics, tracer and health checks.
+	// The client always verifies TLS (SKIP_SSL_VALIDATION only applies to
+	// the proxy's own requests).
+	s := sidecar.New(sidecar.Config{
+		Name:       "sidecar",
+		ExpvarName: "Sidecar",
+		Client: transport.NewClient(transport.Config{
+			DialTimeout:           reverseProxyCfg.ClientDialTimeout,
+			TLSHandshakeTimeout:   reverseProxyCfg.ClientTLSHandshakeTimeout,
+			ResponseHeaderTimeout: reverseProxyCfg.ClientResponseHeaderTimeout,
+		}, reverseProxyCfg.ClientTimeout),
+		CAPIAddr:                reverseProxyCfg.VcapApplication.CAPIAddr,
+		UAAAddr:                 reverseProxyCfg.UAAAddr,
+		HealthTimeout:           reverseProxyCfg.ClientTimeout,
+		LoggregatorIngressURL:   reverseProxyCfg.LoggregatorIngressURL,
+		LoggregatorEmitInterval: reverseProxyCfg.LoggregatorEmitInterval,
+		SourceID:                reverseProxyCfg.VcapApplication.ApplicationID,
+		InstanceIndex:           reverseProxyCfg.InstanceIndex,
+		OTLPAddr:                reverseProxyCfg.OTLPAddr,
+		OTLPFlushInterval:       reverseProxyCfg.OTLPFlushInterval,
+		ServerReadHeaderTimeout: reverseProxyCfg.ServerReadHeaderTimeout,
+		ServerReadTimeout:       reverseProxyCfg.ServerReadTimeout,
+		ServerWriteTimeout:      reverseProxyCfg.ServerWriteTimeout,
+		ServerIdleTimeout:       reverseProxyCfg.ServerIdleTimeout,
+	}, log)
+
+	// The proxy is created first so that the reverse proxy can call CAPI
+	// through it.
+	proxyServers := sidecar.NewProxy(proxyCfg, s)
+	servers := append(sidecar.NewReverseProxy(reverseProxyCfg, s), proxyServers...)
+	if err := s.Serve(cfg.HealthPort, reverseProxyCfg.ShutdownGracePeriod, servers...); err != nil {
+		log.Fatalf("failed to serve: %s", err)
+	}
+}
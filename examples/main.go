@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 )
@@ -15,6 +18,7 @@ func main() {
 	log.Println("Starting sample...")
 	defer log.Println("Closing sample...")
 	api := getAPI()
+	client := newClient()
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v3/apps", api), nil)
@@ -22,7 +26,7 @@ func main() {
 			log.Panicf("failed to create request: %s", err)
 		}
 
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			log.Fatalf("error while requesting from API: %s", err)
 		}
@@ -67,6 +71,27 @@ func main() {
 	})))
 }
 
+// newClient returns a client that sends every request through the proxy's
+// Unix socket when PROXY_SOCKET is set. Otherwise HTTP_PROXY is used.
+func newClient() *http.Client {
+	socket := os.Getenv("PROXY_SOCKET")
+	if socket == "" {
+		return http.DefaultClient
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			// The proxy's URL only makes the requests proxy requests. The
+			// connection is always made to the socket.
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "proxy"}),
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
 func getAPI() string {
 	vcap := os.Getenv("VCAP_APPLICATION")
 	var m map[string]interface{}
@@ -2,11 +2,11 @@
 
 set -e
 
-PORT=9999 ./proxy &
+PORT=9999 PROXY_HEALTH_PORT=8081 PROXY_SOCKET=/tmp/proxy.sock ./proxy &
 echo $! > /tmp/pids
-HTTP_PROXY=localhost:9999 PORT=10000 ./examples &
+PROXY_SOCKET=/tmp/proxy.sock PORT=10000 ./examples &
 echo $! >> /tmp/pids
-HTTP_PROXY=localhost:9999 BACKEND_PORT=10000 ./reverse-proxy &
+HTTP_PROXY=localhost:9999 REVERSE_PROXY_HEALTH_PORT=8082 BACKEND_PORT=10000 ./reverse-proxy &
 echo $! >> /tmp/pids
 
 # Close everything, otherwise the container won't be reset
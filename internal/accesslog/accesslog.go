@@ -0,0 +1,68 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Entry is a single access log line. It purposely does not have a place for
+// headers or query parameters so that tokens are never written.
+type Entry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Duration  float64   `json:"duration_seconds"`
+	Bytes     int       `json:"bytes"`
+
+	// Proxy only
+	Cache          string `json:"cache,omitempty"`
+	TokenInjected  bool   `json:"token_injected,omitempty"`
+	TokenRefreshed bool   `json:"token_refreshed,omitempty"`
+
+	// Reverse proxy only
+	Validation string `json:"validation,omitempty"`
+}
+
+// Logger writes sampled access log entries as JSON lines.
+type Logger struct {
+	mu         sync.Mutex
+	w          io.Writer
+	sampleRate float64
+	log        logger.Logger
+}
+
+// New returns a new Logger. The sample rate is the fraction (0 to 1) of
+// entries that are written. A sample rate of 0 disables the access log.
+func New(w io.Writer, sampleRate float64, log logger.Logger) *Logger {
+	return &Logger{
+		w:          w,
+		sampleRate: sampleRate,
+		log:        log,
+	}
+}
+
+// Log writes the entry if it is sampled.
+func (l *Logger) Log(e Entry) {
+	if l.sampleRate <= 0 || (l.sampleRate < 1 && rand.Float64() >= l.sampleRate) {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		l.log.Panicf("failed to marshal access log entry: %s", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		l.log.Errorf("failed to write access log entry: %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/accesslog"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TA struct {
+	*testing.T
+	buf *bytes.Buffer
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TA {
+		return TA{
+			T:   t,
+			buf: &bytes.Buffer{},
+		}
+	})
+
+	o.Spec("writes each entry as a JSON line", func(t TA) {
+		l := accesslog.New(t.buf, 1, logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
+		l.Log(accesslog.Entry{
+			Timestamp:     time.Unix(0, 0).UTC(),
+			Method:        "GET",
+			Host:          "some.url",
+			Path:          "/v3/apps",
+			Status:        200,
+			Duration:      0.5,
+			Bytes:         99,
+			Cache:         "hit",
+			TokenInjected: true,
+		})
+		l.Log(accesslog.Entry{})
+
+		lines := strings.Split(strings.TrimSpace(t.buf.String()), "\n")
+		Expect(t, lines).To(HaveLen(2))
+		Expect(t, lines[0]).To(MatchJSON(`{
+			"timestamp": "1970-01-01T00:00:00Z",
+			"method": "GET",
+			"host": "some.url",
+			"path": "/v3/apps",
+			"status": 200,
+			"duration_seconds": 0.5,
+			"bytes": 99,
+			"cache": "hit",
+			"token_injected": true
+		}`))
+
+		var m map[string]interface{}
+		Expect(t, json.Unmarshal([]byte(lines[1]), &m)).To(BeNil())
+	})
+
+	o.Spec("does not write anything with a sample rate of 0", func(t TA) {
+		l := accesslog.New(t.buf, 0, logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
+		for i := 0; i < 100; i++ {
+			l.Log(accesslog.Entry{})
+		}
+
+		Expect(t, t.buf.Len()).To(Equal(0))
+	})
+
+	o.Spec("samples entries", func(t TA) {
+		l := accesslog.New(t.buf, 0.5, logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
+		for i := 0; i < 1000; i++ {
+			l.Log(accesslog.Entry{})
+		}
+
+		lines := strings.Split(strings.TrimSpace(t.buf.String()), "\n")
+		Expect(t, len(lines)).To(BeAbove(250))
+		Expect(t, len(lines)).To(BeBelow(750))
+	})
+}
@@ -0,0 +1,151 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+
+	// Open rejects every call until the cooldown has passed.
+	Open
+
+	// HalfOpen lets a single trial call through. Its outcome decides if the
+	// breaker closes or opens again.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker is a circuit breaker. It opens after a number of consecutive
+// failures and lets a trial call through after the cooldown.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	log       logger.Logger
+
+	stateGauge  func(value float64, labelValues ...string)
+	transitions func(delta uint64, labelValues ...string)
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// New returns a new Breaker. A threshold of 0 or less disables the breaker
+// (it never opens).
+func New(name string, threshold int, cooldown time.Duration, m metrics.Metrics, log logger.Logger) *Breaker {
+	b := &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		log:       log,
+
+		stateGauge:  m.NewLabeledGauge("CircuitBreakerState", "name"),
+		transitions: m.NewLabeledCounter("CircuitBreakerTransitions", "name", "state"),
+	}
+	b.stateGauge(float64(Closed), name)
+
+	return b
+}
+
+// Allow reports whether a call should be made. Each allowed call must be
+// followed by Success or Failure.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(HalfOpen)
+		b.trial = true
+		return true
+	case HalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful call.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	if b.state != Closed {
+		b.setState(Closed)
+	}
+}
+
+// Failure records a failed call.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.threshold <= 0 {
+		return
+	}
+
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(Open)
+	}
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) setState(s State) {
+	fields := logger.Fields{
+		"breaker":  b.name,
+		"from":     b.state.String(),
+		"to":       s.String(),
+		"failures": b.failures,
+	}
+	if s == Open {
+		b.log.With(fields).Warnf("circuit breaker opened")
+	} else {
+		b.log.With(fields).Infof("circuit breaker state changed")
+	}
+
+	b.state = s
+	b.stateGauge(float64(s), b.name)
+	b.transitions(1, b.name, s.String())
+}
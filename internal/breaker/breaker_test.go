@@ -0,0 +1,94 @@
+package breaker_test
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/breaker"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TB struct {
+	*testing.T
+	m   *expvar.Map
+	log *bytes.Buffer
+	b   *breaker.Breaker
+}
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TB {
+		m := new(expvar.Map).Init()
+		log := &bytes.Buffer{}
+		return TB{
+			T:   t,
+			m:   m,
+			log: log,
+			b:   breaker.New("some-name", 2, 50*time.Millisecond, metrics.New(m), logger.New(log, "", logger.Debug, logger.Text)),
+		}
+	})
+
+	o.Spec("opens after consecutive failures", func(t TB) {
+		Expect(t, t.b.Allow()).To(BeTrue())
+		t.b.Failure()
+		Expect(t, t.b.Allow()).To(BeTrue())
+		t.b.Success()
+		Expect(t, t.b.Allow()).To(BeTrue())
+		t.b.Failure()
+		Expect(t, t.b.State()).To(Equal(breaker.Closed))
+
+		Expect(t, t.b.Allow()).To(BeTrue())
+		t.b.Failure()
+		Expect(t, t.b.State()).To(Equal(breaker.Open))
+		Expect(t, t.b.Allow()).To(BeFalse())
+		Expect(t, t.log.String()).To(ContainSubstring("circuit breaker opened"))
+	})
+
+	o.Spec("lets a single trial through after the cooldown", func(t TB) {
+		t.b.Failure()
+		t.b.Failure()
+		time.Sleep(60 * time.Millisecond)
+
+		Expect(t, t.b.Allow()).To(BeTrue())
+		Expect(t, t.b.State()).To(Equal(breaker.HalfOpen))
+		Expect(t, t.b.Allow()).To(BeFalse())
+
+		t.b.Failure()
+		Expect(t, t.b.State()).To(Equal(breaker.Open))
+		Expect(t, t.b.Allow()).To(BeFalse())
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(t, t.b.Allow()).To(BeTrue())
+		t.b.Success()
+		Expect(t, t.b.State()).To(Equal(breaker.Closed))
+		Expect(t, t.b.Allow()).To(BeTrue())
+	})
+
+	o.Spec("records the state and transitions", func(t TB) {
+		t.b.Failure()
+		t.b.Failure()
+
+		state := t.m.Get("CircuitBreakerState").(*expvar.Map).Get("name=some-name")
+		Expect(t, state.String()).To(Equal("1"))
+
+		transitions := t.m.Get("CircuitBreakerTransitions").(*expvar.Map).Get("name=some-name,state=open")
+		Expect(t, transitions.String()).To(Equal("1"))
+	})
+
+	o.Spec("never opens with a threshold of 0", func(t TB) {
+		b := breaker.New("other", 0, time.Minute, metrics.New(nil), logger.New(t.log, "", logger.Debug, logger.Text))
+		for i := 0; i < 10; i++ {
+			b.Failure()
+		}
+		Expect(t, b.Allow()).To(BeTrue())
+	})
+}
@@ -2,75 +2,57 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"sort"
 	"time"
 
+	"github.com/poy/cf-space-security/internal/logger"
 	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/tracing"
 	"github.com/bluele/gcache"
 )
 
+// loadTimeout bounds a coalesced upstream request. It no longer ends with
+// the request that started it, as others may be waiting on it.
+const loadTimeout = 30 * time.Second
+
 type Cache struct {
 	proxyCreator func(*http.Request) http.Handler
+	expire       time.Duration
+	cacheMiss    func(uint64)
 	cacheGetReqs func(uint64)
+	cacheResults func(uint64, ...string)
+	coalesced    func(uint64)
 
 	c   gcache.Cache
-	log *log.Logger
+	g   group
+	log logger.Logger
 }
 
-func New(size int, expire time.Duration, proxyCreator func(r *http.Request) http.Handler, m metrics.Metrics, log *log.Logger) *Cache {
-	cacheMiss := m.NewCounter("CacheMisses")
-	dontKeep := time.Duration(0)
-
+func New(size int, expire time.Duration, proxyCreator func(r *http.Request) http.Handler, m metrics.Metrics, log logger.Logger) *Cache {
 	var c gcache.Cache
 	if size > 0 {
 		c = gcache.New(size).
 			LRU().
-			LoaderExpireFunc(func(key interface{}) (interface{}, *time.Duration, error) {
-				cacheMiss(1)
-				var req request
-				if err := json.Unmarshal([]byte(key.(string)), &req); err != nil {
-					log.Panic(err)
-				}
-
-				r, err := http.NewRequest(http.MethodGet, req.URL, nil)
-				if err != nil {
-					log.Panic(err)
-				}
-
-				for _, header := range req.Headers {
-					r.Header[header.Name] = header.Values
-				}
-
-				recorder := httptest.NewRecorder()
-				proxyCreator(r).ServeHTTP(recorder, r)
-
-				if recorder.Code >= 400 {
-					return recorder, &dontKeep, nil
-				}
-
-				return recorder, &expire, nil
-			}).
 			Build()
 	}
 
 	return &Cache{
 		c:            c,
+		expire:       expire,
+		cacheMiss:    m.NewCounter("CacheMisses"),
 		cacheGetReqs: m.NewCounter("CacheGetRequests"),
+		cacheResults: m.NewLabeledCounter("CacheResults", "host", "result"),
+		coalesced:    m.NewCounter("CacheCoalescedRequests"),
 		proxyCreator: proxyCreator,
 		log:          log,
 	}
 }
 
-type response struct {
-	StatusCode int
-	Body       []byte
-}
-
 type request struct {
 	URL     string
 	Headers []struct {
@@ -79,17 +61,113 @@ type request struct {
 	}
 }
 
+// lookup is the result of a lookup and whether it was cached.
+type lookup struct {
+	rec *httptest.ResponseRecorder
+	hit bool
+}
+
 func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Serve(w, r)
+}
+
+// Serve is ServeHTTP that also reports whether the response was cached
+// ("hit"), fetched ("miss") or the cache was bypassed ("bypass").
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request) string {
 	if c.c == nil || r.Method != http.MethodGet {
 		c.proxyCreator(r).ServeHTTP(w, r)
-		return
+		return "bypass"
+	}
+
+	// Concurrent requests for the same key (e.g., while an expired entry
+	// is being reloaded) share a single upstream request. The first
+	// request is sent upstream with its trace headers and context values,
+	// but it is not canceled if that request goes away.
+	key := c.key(r)
+	v, _, shared := c.g.do(key, func() (interface{}, error) {
+		if rec, err := c.c.GetIFPresent(key); err == nil {
+			return lookup{rec: rec.(*httptest.ResponseRecorder), hit: true}, nil
+		}
+
+		return lookup{rec: c.load(key, r)}, nil
+	})
+	if shared {
+		c.coalesced(1)
 	}
 
+	l := v.(lookup)
+	for k, v := range l.rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(l.rec.Code)
+	io.Copy(w, bytes.NewReader(l.rec.Body.Bytes()))
+
+	result := "miss"
+	if l.hit {
+		result = "hit"
+	}
+	c.cacheGetReqs(1)
+	c.cacheResults(1, r.Host, result)
+
+	return result
+}
+
+// load sends the request upstream and caches the response unless it
+// failed.
+func (c *Cache) load(key string, r *http.Request) *httptest.ResponseRecorder {
+	c.cacheMiss(1)
+	c.log.With(logger.Fields{"url": r.URL.String()}).Debugf("cache miss")
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), loadTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	rec := httptest.NewRecorder()
+	c.proxyCreator(r).ServeHTTP(rec, r)
+
+	if rec.Code < 400 {
+		if err := c.c.SetWithExpire(key, rec, c.expire); err != nil {
+			c.log.Errorf("failed writing to request cache: %s", err)
+		}
+	}
+
+	return rec
+}
+
+// Stats describes what is in the cache and how often it was used.
+type Stats struct {
+	Entries int     `json:"entries"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// Stats returns the cache's stats. A cache of size 0 has none.
+func (c *Cache) Stats() Stats {
+	if c.c == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Entries: c.c.Len(true),
+		Hits:    c.c.HitCount(),
+		Misses:  c.c.MissCount(),
+		HitRate: c.c.HitRate(),
+	}
+}
+
+// key returns the cache key for the request. Trace context headers are
+// ignored as they are unique to each request.
+func (c *Cache) key(r *http.Request) string {
 	var h []struct {
 		Name   string
 		Values []string
 	}
 	for k, v := range r.Header {
+		if traceHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+
 		sort.Strings(v)
 		h = append(h, struct {
 			Name   string
@@ -106,25 +184,19 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Headers: h,
 	})
 	if err != nil {
-		log.Panic(err)
+		c.log.Panicf("failed to marshal cache key: %s", err)
 	}
 
-	recorder, err := c.c.Get(string(data))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		c.log.Printf("failed reading from request cache: %s", err)
-		return
-	}
+	return string(data)
+}
 
-	rec := recorder.(*httptest.ResponseRecorder)
-	for k, v := range rec.Header() {
-		w.Header()[k] = v
+var traceHeaders = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, h := range tracing.Headers {
+		m[h] = true
 	}
-	w.WriteHeader(rec.Code)
-	io.Copy(w, bytes.NewReader(rec.Body.Bytes()))
-
-	c.cacheGetReqs(1)
-}
+	return m
+}()
 
 type headers []struct {
 	Name   string
@@ -1,15 +1,17 @@
 package cache_test
 
 import (
+	"context"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/poy/cf-space-security/internal/cache"
+	"github.com/poy/cf-space-security/internal/logger"
 	"github.com/poy/cf-space-security/internal/metrics"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
@@ -36,7 +38,7 @@ func TestCache(t *testing.T) {
 			T:          t,
 			spyMetrics: spyMetrics,
 			spyHandler: spyHandler,
-			c:          cache.New(1, time.Second, func(*http.Request) http.Handler { return spyHandler }, spyMetrics, log.New(ioutil.Discard, "", 0)),
+			c:          cache.New(1, time.Second, func(*http.Request) http.Handler { return spyHandler }, spyMetrics, logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
 			recorder:   httptest.NewRecorder(),
 		}
 	})
@@ -61,6 +63,19 @@ func TestCache(t *testing.T) {
 		Expect(t, t.spyMetrics.GetDelta("CacheGetRequests")).To(Equal(uint64(2)))
 	})
 
+	o.Spec("counts hits and misses by host", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.c.ServeHTTP(t.recorder, req)
+		t.c.ServeHTTP(httptest.NewRecorder(), req)
+		t.c.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(t, t.spyMetrics.GetDelta("CacheResults", "some.url", "miss")).To(Equal(uint64(1)))
+		Expect(t, t.spyMetrics.GetDelta("CacheResults", "some.url", "hit")).To(Equal(uint64(2)))
+	})
+
 	o.Spec("it does not cache a non-2XX", func(t TC) {
 		t.spyHandler.fail = true
 		req, err := http.NewRequest("GET", "http://some.url", nil)
@@ -141,6 +156,59 @@ func TestCache(t *testing.T) {
 		Expect(t, t.spyMetrics.GetDelta("CacheGetRequests")).To(Equal(uint64(2)))
 	})
 
+	o.Spec("reports stats", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://some.url", nil)
+			Expect(t, err).To(BeNil())
+			t.c.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		stats := t.c.Stats()
+		Expect(t, stats.Entries).To(Equal(1))
+		Expect(t, stats.Hits).To(Equal(uint64(1)))
+		Expect(t, stats.Misses).To(Equal(uint64(1)))
+	})
+
+	o.Spec("ignores trace headers", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		t.c.ServeHTTP(t.recorder, req)
+
+		req, err = http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-a3ce929d0e0e4736-01")
+		t.c.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(t, t.spyHandler.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("sends trace headers upstream on a miss", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		t.c.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.spyHandler.reqs).To(HaveLen(1))
+		Expect(t, t.spyHandler.reqs[0].Header.Get("traceparent")).To(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	})
+
+	o.Spec("reports whether the response was cached", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.c.Serve(httptest.NewRecorder(), req)).To(Equal("miss"))
+		Expect(t, t.c.Serve(httptest.NewRecorder(), req)).To(Equal("hit"))
+
+		req, err = http.NewRequest("POST", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.c.Serve(httptest.NewRecorder(), req)).To(Equal("bypass"))
+	})
+
 	o.Spec("ignores non-GET requests", func(t TC) {
 		req, err := http.NewRequest("POST", "http://some.url", nil)
 		Expect(t, err).To(BeNil())
@@ -155,7 +223,7 @@ func TestCache(t *testing.T) {
 	})
 
 	o.Spec("does not cache if size is 0", func(t TC) {
-		t.c = cache.New(0, time.Second, func(*http.Request) http.Handler { return t.spyHandler }, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+		t.c = cache.New(0, time.Second, func(*http.Request) http.Handler { return t.spyHandler }, t.spyMetrics, logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
 		req, err := http.NewRequest("GET", "http://some.url", nil)
 		Expect(t, err).To(BeNil())
 
@@ -167,10 +235,111 @@ func TestCache(t *testing.T) {
 		Expect(t, t.spyMetrics.GetDelta("CacheMisses")).To(Equal(uint64(0)))
 		Expect(t, t.spyMetrics.GetDelta("CacheGetRequests")).To(Equal(uint64(0)))
 	})
+
+	o.Spec("coalesces concurrent requests for the same key", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		t.spyHandler.block = make(chan struct{})
+
+		var wg sync.WaitGroup
+		recorders := make([]*httptest.ResponseRecorder, 10)
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(rec *httptest.ResponseRecorder) {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", "http://some.url", nil)
+				t.c.ServeHTTP(rec, req)
+			}(recorders[i])
+		}
+
+		Expect(t, func() int { return len(t.spyHandler.getReqs()) }).To(ViaPolling(Equal(1)))
+		time.Sleep(50 * time.Millisecond)
+		close(t.spyHandler.block)
+		wg.Wait()
+
+		Expect(t, t.spyHandler.getReqs()).To(HaveLen(1))
+		for _, rec := range recorders {
+			Expect(t, rec.Code).To(Equal(http.StatusOK))
+			Expect(t, rec.Body.String()).To(Equal("http://some.url"))
+		}
+		Expect(t, t.spyMetrics.GetDelta("CacheCoalescedRequests")).To(Equal(uint64(9)))
+	})
+
+	o.Spec("finishes a coalesced request after the first caller goes away", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		t.spyHandler.block = make(chan struct{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		first := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			req, _ := http.NewRequest("GET", "http://some.url", nil)
+			t.c.ServeHTTP(first, req.WithContext(ctx))
+		}()
+		Expect(t, func() int { return len(t.spyHandler.getReqs()) }).To(ViaPolling(Equal(1)))
+
+		var wg sync.WaitGroup
+		recorders := make([]*httptest.ResponseRecorder, 4)
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(rec *httptest.ResponseRecorder) {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", "http://some.url", nil)
+				t.c.ServeHTTP(rec, req)
+			}(recorders[i])
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		close(t.spyHandler.block)
+		wg.Wait()
+		<-done
+
+		Expect(t, t.spyHandler.getReqs()).To(HaveLen(1))
+		for _, rec := range recorders {
+			Expect(t, rec.Code).To(Equal(http.StatusOK))
+		}
+	})
+
+	o.Spec("coalesces concurrent requests while reloading an expired entry", func(t TC) {
+		t.spyHandler.code = http.StatusOK
+		t.c = cache.New(1, 10*time.Millisecond, func(*http.Request) http.Handler { return t.spyHandler }, t.spyMetrics, logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.c.ServeHTTP(t.recorder, req)
+		time.Sleep(20 * time.Millisecond)
+
+		t.spyHandler.block = make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", "http://some.url", nil)
+				t.c.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+		}
+
+		Expect(t, func() int { return len(t.spyHandler.getReqs()) }).To(ViaPolling(Equal(2)))
+		time.Sleep(50 * time.Millisecond)
+		close(t.spyHandler.block)
+		wg.Wait()
+
+		Expect(t, t.spyHandler.getReqs()).To(HaveLen(2))
+		Expect(t, t.spyMetrics.GetDelta("CacheCoalescedRequests")).To(Equal(uint64(4)))
+	})
 }
 
 type spyHandler struct {
-	fail bool
+	fail  bool
+	code  int
+	block chan struct{}
+
+	mu   sync.Mutex
 	reqs []*http.Request
 }
 
@@ -178,14 +347,36 @@ func newSpyHandler() *spyHandler {
 	return &spyHandler{}
 }
 
+func (s *spyHandler) getReqs() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqs
+}
+
 func (s *spyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
 	s.reqs = append(s.reqs, r)
+	s.mu.Unlock()
+
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-r.Context().Done():
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+
 	if s.fail {
 		w.WriteHeader(500)
 		return
 	}
 
-	w.WriteHeader(len(r.URL.String()))
+	if s.code != 0 {
+		w.WriteHeader(s.code)
+	} else {
+		w.WriteHeader(len(r.URL.String()))
+	}
 	w.Write([]byte(r.URL.String()))
 }
 
@@ -210,8 +401,16 @@ func (s *spyMetrics) NewCounter(name string) func(uint64) {
 	}
 }
 
-func (s *spyMetrics) GetDelta(name string) uint64 {
+func (s *spyMetrics) NewLabeledCounter(name string, labels ...string) func(uint64, ...string) {
+	return func(delta uint64, labelValues ...string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.m[strings.Join(append([]string{name}, labelValues...), ":")] += delta
+	}
+}
+
+func (s *spyMetrics) GetDelta(name string, labelValues ...string) uint64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m[name]
+	return s.m[strings.Join(append([]string{name}, labelValues...), ":")]
 }
@@ -0,0 +1,46 @@
+package cache
+
+import "sync"
+
+// group coalesces concurrent calls with the same key into a single call.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// do calls fn once for each set of concurrent callers with the same key.
+// Every caller gets the same result. shared reports whether the result came
+// from another caller's call.
+func (g *group) do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
@@ -0,0 +1,180 @@
+package capi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/poy/cf-space-security/internal/breaker"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+)
+
+// FailureMode is how tokens are validated while CAPI is unavailable.
+type FailureMode int
+
+const (
+	// FailClosed rejects every token.
+	FailClosed FailureMode = iota
+
+	// LastKnownGood uses the last decision CAPI made for the token. Tokens
+	// without a decision are rejected.
+	LastKnownGood
+
+	// FailOpen accepts tokens with a valid signature.
+	FailOpen
+)
+
+func (m FailureMode) String() string {
+	switch m {
+	case LastKnownGood:
+		return "last-known-good"
+	case FailOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// UnmarshalEnv implements envstruct.Unmarshaller.
+func (m *FailureMode) UnmarshalEnv(data string) error {
+	switch strings.ToLower(data) {
+	case "closed", "":
+		*m = FailClosed
+	case "last-known-good":
+		*m = LastKnownGood
+	case "open":
+		*m = FailOpen
+	default:
+		return fmt.Errorf("unknown failure mode: %s", data)
+	}
+
+	return nil
+}
+
+// TokenValidator validates a token.
+type TokenValidator interface {
+	Validate(token string) Result
+}
+
+// TokenVerifier verifies a token's signature.
+type TokenVerifier interface {
+	Verify(token string) error
+}
+
+// FallbackValidator guards a TokenValidator with a circuit breaker. While
+// the breaker is open (or a validation fails), tokens are validated
+// according to the FailureMode.
+type FallbackValidator struct {
+	v    TokenValidator
+	b    *breaker.Breaker
+	mode FailureMode
+	tv   TokenVerifier
+	log  logger.Logger
+
+	decisions gcache.Cache
+	fallbacks func(delta uint64, labelValues ...string)
+}
+
+// NewFallbackValidator returns a new FallbackValidator. Up to size decisions
+// are kept for the given TTL (only used by LastKnownGood). The verifier is
+// only used by FailOpen.
+func NewFallbackValidator(
+	v TokenValidator,
+	b *breaker.Breaker,
+	mode FailureMode,
+	size int,
+	ttl time.Duration,
+	tv TokenVerifier,
+	m metrics.Metrics,
+	log logger.Logger,
+) *FallbackValidator {
+	fv := &FallbackValidator{
+		v:    v,
+		b:    b,
+		mode: mode,
+		tv:   tv,
+		log:  log,
+
+		fallbacks: m.NewLabeledCounter("CAPIValidationFallbacks", "mode", "status"),
+	}
+
+	if mode == LastKnownGood {
+		fv.decisions = gcache.New(size).LRU().Expiration(ttl).Build()
+	}
+
+	return fv
+}
+
+// CachedDecisions returns how many decisions are kept for LastKnownGood.
+func (v *FallbackValidator) CachedDecisions() int {
+	if v.decisions == nil {
+		return 0
+	}
+
+	return v.decisions.Len(true)
+}
+
+func (v *FallbackValidator) Validate(token string) Result {
+	if token == "" {
+		return v.v.Validate(token)
+	}
+
+	if !v.b.Allow() {
+		return v.fallback(token, "CAPI circuit breaker is open")
+	}
+
+	r := v.v.Validate(token)
+	if r.Status == Unavailable {
+		v.b.Failure()
+		return v.fallback(token, r.Reason)
+	}
+	v.b.Success()
+
+	if v.decisions != nil && (r.Status == Valid || r.Status == Forbidden) {
+		v.decisions.Set(hashToken(token), r)
+	}
+
+	return r
+}
+
+func (v *FallbackValidator) fallback(token, reason string) Result {
+	r := Result{Status: Unavailable, Reason: reason}
+
+	switch v.mode {
+	case LastKnownGood:
+		if d, err := v.decisions.Get(hashToken(token)); err == nil {
+			r = d.(Result)
+		}
+
+		// The decision may outlive the token.
+		if i, err := identity.FromToken(token); err == nil && !i.ExpiresAt.IsZero() && i.ExpiresAt.Before(time.Now()) {
+			r = Result{Status: Invalid, Reason: "token is expired"}
+		}
+	case FailOpen:
+		if err := v.tv.Verify(token); err != nil {
+			r = Result{Status: Invalid, Reason: "token signature could not be verified"}
+		} else {
+			r = Result{Status: Valid}
+		}
+	}
+
+	v.fallbacks(1, v.mode.String(), r.Status.String())
+	v.log.With(logger.Fields{
+		"mode":   v.mode.String(),
+		"status": r.Status.String(),
+		"reason": reason,
+	}).Debugf("CAPI unavailable, validated token via fallback")
+
+	return r
+}
+
+// hashToken keeps the raw tokens out of memory.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
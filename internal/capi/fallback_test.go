@@ -0,0 +1,182 @@
+package capi_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/breaker"
+	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TF struct {
+	*testing.T
+	spyValidator *spyValidator
+	spyVerifier  *spyVerifier
+	spyMetrics   *spyMetrics
+	b            *breaker.Breaker
+	newValidator func(capi.FailureMode) *capi.FallbackValidator
+}
+
+func TestFallbackValidator(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TF {
+		spyValidator := newSpyValidator()
+		spyVerifier := newSpyVerifier()
+		spyMetrics := newSpyMetrics()
+		log := logger.New(ioutil.Discard, "", logger.Debug, logger.Text)
+		b := breaker.New("capi", 2, time.Minute, metrics.New(nil), log)
+
+		return TF{
+			T:            t,
+			spyValidator: spyValidator,
+			spyVerifier:  spyVerifier,
+			spyMetrics:   spyMetrics,
+			b:            b,
+			newValidator: func(mode capi.FailureMode) *capi.FallbackValidator {
+				return capi.NewFallbackValidator(spyValidator, b, mode, 100, time.Minute, spyVerifier, spyMetrics, log)
+			},
+		}
+	})
+
+	o.Spec("passes through results while CAPI is available", func(t TF) {
+		v := t.newValidator(capi.FailClosed)
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Forbidden}
+
+		Expect(t, v.Validate("some-token").Status).To(Equal(capi.Forbidden))
+		Expect(t, t.spyValidator.calls).To(Equal(1))
+	})
+
+	o.Spec("opens the breaker after failures", func(t TF) {
+		v := t.newValidator(capi.FailClosed)
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Unavailable}
+
+		v.Validate("some-token")
+		v.Validate("some-token")
+		Expect(t, t.b.State()).To(Equal(breaker.Open))
+
+		r := v.Validate("some-token")
+		Expect(t, r.Status).To(Equal(capi.Unavailable))
+		Expect(t, t.spyValidator.calls).To(Equal(2))
+		Expect(t, t.spyMetrics.GetDelta("CAPIValidationFallbacks", "closed", "unavailable")).To(Equal(uint64(3)))
+	})
+
+	o.Spec("uses the last known decision", func(t TF) {
+		v := t.newValidator(capi.LastKnownGood)
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Valid}
+		t.spyValidator.results["forbidden-token"] = capi.Result{Status: capi.Forbidden}
+		v.Validate("some-token")
+		v.Validate("forbidden-token")
+
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Unavailable}
+		t.spyValidator.results["forbidden-token"] = capi.Result{Status: capi.Unavailable}
+		t.spyValidator.results["other-token"] = capi.Result{Status: capi.Unavailable}
+
+		Expect(t, v.Validate("some-token").Status).To(Equal(capi.Valid))
+		Expect(t, v.Validate("forbidden-token").Status).To(Equal(capi.Forbidden))
+		Expect(t, v.Validate("other-token").Status).To(Equal(capi.Unavailable))
+	})
+
+	o.Spec("does not use the last known decision for expired tokens", func(t TF) {
+		v := t.newValidator(capi.LastKnownGood)
+		expired := newToken(t.T, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})
+		t.spyValidator.results[expired] = capi.Result{Status: capi.Valid}
+		v.Validate(expired)
+
+		t.spyValidator.results[expired] = capi.Result{Status: capi.Unavailable}
+		r := v.Validate(expired)
+		Expect(t, r.Status).To(Equal(capi.Invalid))
+		Expect(t, r.Reason).To(Equal("token is expired"))
+	})
+
+	o.Spec("does not remember invalid tokens", func(t TF) {
+		v := t.newValidator(capi.LastKnownGood)
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Invalid}
+		v.Validate("some-token")
+
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Unavailable}
+		Expect(t, v.Validate("some-token").Status).To(Equal(capi.Unavailable))
+	})
+
+	o.Spec("accepts verified tokens when failing open", func(t TF) {
+		v := t.newValidator(capi.FailOpen)
+		t.spyValidator.results["some-token"] = capi.Result{Status: capi.Unavailable}
+		t.spyValidator.results["bad-token"] = capi.Result{Status: capi.Unavailable}
+		t.spyVerifier.errs["bad-token"] = errors.New("some-error")
+
+		Expect(t, v.Validate("some-token").Status).To(Equal(capi.Valid))
+		Expect(t, v.Validate("bad-token").Status).To(Equal(capi.Invalid))
+		Expect(t, t.spyMetrics.GetDelta("CAPIValidationFallbacks", "open", "valid")).To(Equal(uint64(1)))
+		Expect(t, t.spyMetrics.GetDelta("CAPIValidationFallbacks", "open", "invalid")).To(Equal(uint64(1)))
+	})
+
+	o.Spec("does not fall back for missing tokens", func(t TF) {
+		v := t.newValidator(capi.FailOpen)
+		t.spyValidator.results[""] = capi.Result{Status: capi.Invalid}
+
+		Expect(t, v.Validate("").Status).To(Equal(capi.Invalid))
+		Expect(t, t.spyVerifier.tokens).To(HaveLen(0))
+	})
+
+	o.Spec("reads the failure mode", func(t TF) {
+		var m capi.FailureMode
+		Expect(t, m.UnmarshalEnv("last-known-good")).To(BeNil())
+		Expect(t, m).To(Equal(capi.LastKnownGood))
+		Expect(t, m.UnmarshalEnv("open")).To(BeNil())
+		Expect(t, m).To(Equal(capi.FailOpen))
+		Expect(t, m.UnmarshalEnv("closed")).To(BeNil())
+		Expect(t, m).To(Equal(capi.FailClosed))
+		Expect(t, m.UnmarshalEnv("invalid")).To(Not(BeNil()))
+	})
+}
+
+type spyValidator struct {
+	results map[string]capi.Result
+	calls   int
+}
+
+func newSpyValidator() *spyValidator {
+	return &spyValidator{
+		results: make(map[string]capi.Result),
+	}
+}
+
+func (s *spyValidator) Validate(token string) capi.Result {
+	s.calls++
+	return s.results[token]
+}
+
+type spyVerifier struct {
+	errs   map[string]error
+	tokens []string
+}
+
+func newSpyVerifier() *spyVerifier {
+	return &spyVerifier{
+		errs: make(map[string]error),
+	}
+}
+
+func (s *spyVerifier) Verify(token string) error {
+	s.tokens = append(s.tokens, token)
+	return s.errs[token]
+}
+
+func newToken(t *testing.T, c jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte("some-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "bearer " + token
+}
@@ -4,14 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+
+	"github.com/poy/cf-space-security/internal/logger"
 )
 
 type Restager struct {
 	f       TokenFetcher
 	d       Doer
-	log     *log.Logger
+	log     logger.Logger
 	apiAddr string
 	appID   string
 }
@@ -24,7 +25,7 @@ type TokenFetcher interface {
 	Token() string
 }
 
-func NewRestager(appID, apiAddr string, f TokenFetcher, d Doer, log *log.Logger) *Restager {
+func NewRestager(appID, apiAddr string, f TokenFetcher, d Doer, log logger.Logger) *Restager {
 	return &Restager{
 		f:       f,
 		d:       d,
@@ -3,11 +3,11 @@ package capi_test
 import (
 	"bytes"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"testing"
 
 	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/logger"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
 	. "github.com/poy/onpar/matchers"
@@ -32,7 +32,7 @@ func TestRestager(t *testing.T) {
 			T:               t,
 			spyTokenFetcher: spyTokenFetcher,
 			spyDoer:         spyDoer,
-			r:               capi.NewRestager("some-id", "https://some.com", spyTokenFetcher, spyDoer, log.New(ioutil.Discard, "", 0)),
+			r:               capi.NewRestager("some-id", "https://some.com", spyTokenFetcher, spyDoer, logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
 		}
 	})
 
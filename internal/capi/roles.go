@@ -0,0 +1,100 @@
+package capi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// RoleFetcher looks up the roles a user has in the app's space.
+type RoleFetcher struct {
+	spaceID  string
+	capiAddr string
+	doer     Doer
+	log      logger.Logger
+
+	roles gcache.Cache
+}
+
+// NewRoleFetcher returns a new RoleFetcher. Up to size users' roles are
+// cached for the ttl. A size of 0 disables the cache.
+func NewRoleFetcher(spaceID, capiAddr string, size int, ttl time.Duration, doer Doer, log logger.Logger) *RoleFetcher {
+	f := &RoleFetcher{
+		spaceID:  spaceID,
+		capiAddr: capiAddr,
+		doer:     doer,
+		log:      log,
+	}
+
+	if size > 0 {
+		f.roles = gcache.New(size).LRU().Expiration(ttl).Build()
+	}
+
+	return f
+}
+
+// SpaceRoles returns the space roles (e.g., developer, manager, auditor) the
+// user has in the app's space. The token is used to make the request on
+// behalf of the user.
+func (f *RoleFetcher) SpaceRoles(token, userID string) ([]string, error) {
+	if f.roles != nil {
+		if roles, err := f.roles.Get(userID); err == nil {
+			return roles.([]string), nil
+		}
+	}
+
+	q := url.Values{
+		"space_guids": {f.spaceID},
+		"user_guids":  {userID},
+		"types":       {"space_developer,space_manager,space_auditor"},
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v3/roles?%s", f.capiAddr, q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", token)
+
+	resp, err := f.doer.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed making request to CAPI (%s): %s", f.capiAddr, err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from CAPI: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Resources []struct {
+			Type string `json:"type"`
+		} `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode CAPI roles: %s", err)
+	}
+
+	var roles []string
+	for _, r := range result.Resources {
+		roles = append(roles, strings.TrimPrefix(r.Type, "space_"))
+	}
+	f.log.With(logger.Fields{"user_id": userID, "roles": roles}).Debugf("fetched space roles")
+
+	if f.roles != nil {
+		f.roles.Set(userID, roles)
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,85 @@
+package capi_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TRF struct {
+	*testing.T
+	spyDoer *spyDoer
+	f       *capi.RoleFetcher
+}
+
+func TestRoleFetcher(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TRF {
+		spyDoer := newSpyDoer()
+		return TRF{
+			T:       t,
+			spyDoer: spyDoer,
+			f:       capi.NewRoleFetcher("some-space", "http://some.url", 10, time.Minute, spyDoer, logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
+		}
+	})
+
+	o.Spec("returns the user's space roles", func(t TRF) {
+		t.spyDoer.m["GET:http://some.url/v3/roles?space_guids=some-space&types=space_developer%2Cspace_manager%2Cspace_auditor&user_guids=some-user"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewReader([]byte(`{
+				"resources": [{"type": "space_developer"}, {"type": "space_auditor"}]
+			}`))),
+		}
+
+		roles, err := t.f.SpaceRoles("some-token", "some-user")
+		Expect(t, err).To(BeNil())
+		Expect(t, roles).To(Equal([]string{"developer", "auditor"}))
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+		Expect(t, t.spyDoer.reqs[0].Header.Get("Authorization")).To(Equal("some-token"))
+	})
+
+	o.Spec("caches the roles of each user", func(t TRF) {
+		t.spyDoer.m["GET:http://some.url/v3/roles?space_guids=some-space&types=space_developer%2Cspace_manager%2Cspace_auditor&user_guids=some-user"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewReader([]byte(`{
+				"resources": [{"type": "space_developer"}]
+			}`))),
+		}
+
+		_, err := t.f.SpaceRoles("some-token", "some-user")
+		Expect(t, err).To(BeNil())
+		roles, err := t.f.SpaceRoles("other-token", "some-user")
+		Expect(t, err).To(BeNil())
+		Expect(t, roles).To(Equal([]string{"developer"}))
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("returns an error for a non-200", func(t TRF) {
+		t.spyDoer.m["GET:http://some.url/v3/roles?space_guids=some-space&types=space_developer%2Cspace_manager%2Cspace_auditor&user_guids=some-user"] = &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.f.SpaceRoles("some-token", "some-user")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("returns an error if the request fails", func(t TRF) {
+		t.spyDoer.err = errors.New("some-error")
+
+		_, err := t.f.SpaceRoles("some-token", "some-user")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
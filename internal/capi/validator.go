@@ -4,29 +4,78 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
 )
 
 type Validator struct {
 	appID    string
 	capiAddr string
 	doer     Doer
-	log      *log.Logger
+	log      logger.Logger
+
+	capiRequests func(delta uint64, labelValues ...string)
+	capiLatency  func(value float64)
 }
 
-func NewValidator(appID, capiAddr string, doer Doer, log *log.Logger) *Validator {
+func NewValidator(appID, capiAddr string, doer Doer, m metrics.Metrics, log logger.Logger) *Validator {
 	return &Validator{
 		appID:    appID,
 		capiAddr: capiAddr,
 		doer:     doer,
 		log:      log,
+
+		capiRequests: m.NewLabeledCounter("CAPIValidationRequests", "status"),
+		capiLatency:  m.NewHistogram("CAPIValidationLatencySeconds", metrics.DefaultBuckets),
 	}
 }
 
-func (v *Validator) Validate(token string) bool {
+// Status is the outcome of validating a token.
+type Status int
+
+const (
+	// Valid tokens have access to the app.
+	Valid Status = iota
+
+	// Invalid tokens are missing, expired or otherwise rejected.
+	Invalid
+
+	// Forbidden tokens are valid but do not have access to the app.
+	Forbidden
+
+	// Unavailable means CAPI (or UAA) could not be reached to validate the
+	// token.
+	Unavailable
+)
+
+func (s Status) String() string {
+	switch s {
+	case Valid:
+		return "valid"
+	case Invalid:
+		return "invalid"
+	case Forbidden:
+		return "forbidden"
+	case Unavailable:
+		return "unavailable"
+	default:
+		return "unknown"
+	}
+}
+
+// Result is the status of a validation and the reason for it.
+type Result struct {
+	Status Status
+	Reason string
+}
+
+func (v *Validator) Validate(token string) Result {
 	if token == "" {
-		return false
+		return Result{Status: Invalid, Reason: "missing token"}
 	}
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v3/apps/%s", v.capiAddr, v.appID), nil)
@@ -35,16 +84,33 @@ func (v *Validator) Validate(token string) bool {
 	}
 	req.Header.Set("Authorization", token)
 
+	start := time.Now()
 	resp, err := v.doer.Do(req)
+	v.capiLatency(time.Since(start).Seconds())
 	if err != nil {
-		v.log.Printf("failed making request to CAPI (%s): %s", v.capiAddr, err)
-		return false
+		v.capiRequests(1, "error")
+		v.log.Errorf("failed making request to CAPI (%s): %s", v.capiAddr, err)
+		return Result{Status: Unavailable, Reason: "unable to reach CAPI"}
 	}
+	v.capiRequests(1, strconv.Itoa(resp.StatusCode))
+	v.log.With(logger.Fields{"status": resp.StatusCode}).Debugf("validated token with CAPI")
 
 	defer func() {
 		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
 	}()
 
-	return resp.StatusCode == http.StatusOK
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return Result{Status: Valid}
+	case resp.StatusCode == http.StatusUnauthorized:
+		return Result{Status: Invalid, Reason: "token is invalid or expired"}
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotFound:
+		// CAPI hides apps the user can not see behind a 404.
+		return Result{Status: Forbidden, Reason: "token does not have access to the app"}
+	case resp.StatusCode >= 500:
+		return Result{Status: Unavailable, Reason: fmt.Sprintf("CAPI returned %d", resp.StatusCode)}
+	default:
+		return Result{Status: Invalid, Reason: fmt.Sprintf("CAPI returned %d", resp.StatusCode)}
+	}
 }
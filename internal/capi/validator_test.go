@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
 	. "github.com/poy/onpar/matchers"
@@ -16,8 +19,9 @@ import (
 
 type TV struct {
 	*testing.T
-	spyDoer *spyDoer
-	v       *capi.Validator
+	spyDoer    *spyDoer
+	spyMetrics *spyMetrics
+	v          *capi.Validator
 }
 
 func TestValidator(t *testing.T) {
@@ -27,49 +31,132 @@ func TestValidator(t *testing.T) {
 
 	o.BeforeEach(func(t *testing.T) TV {
 		spyDoer := newSpyDoer()
+		spyMetrics := newSpyMetrics()
 		return TV{
-			T:       t,
-			spyDoer: spyDoer,
-			v:       capi.NewValidator("some-id", "http://some.url", spyDoer, log.New(ioutil.Discard, "", 0)),
+			T:          t,
+			spyDoer:    spyDoer,
+			spyMetrics: spyMetrics,
+			v:          capi.NewValidator("some-id", "http://some.url", spyDoer, spyMetrics, logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
 		}
 	})
 
-	o.Spec("returns true for a non-200", func(t TV) {
+	o.Spec("returns valid for a 200", func(t TV) {
 		t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
 
-		Expect(t, t.v.Validate("some-token")).To(BeTrue())
+		Expect(t, t.v.Validate("some-token").Status).To(Equal(capi.Valid))
 		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
 		Expect(t, t.spyDoer.reqs[0].Header.Get("Authorization")).To(Equal("some-token"))
 	})
 
-	o.Spec("returns false for a non-200", func(t TV) {
+	o.Spec("returns forbidden if the token can not see the app", func(t TV) {
+		for _, code := range []int{403, 404} {
+			t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
+				StatusCode: code,
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			}
+
+			result := t.v.Validate("some-token")
+			Expect(t, result.Status).To(Equal(capi.Forbidden))
+			Expect(t, result.Reason).To(Not(Equal("")))
+		}
+	})
+
+	o.Spec("returns invalid for a 401", func(t TV) {
 		t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
-			StatusCode: 404,
+			StatusCode: 401,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
 
-		Expect(t, t.v.Validate("some-token")).To(BeFalse())
+		Expect(t, t.v.Validate("some-token").Status).To(Equal(capi.Invalid))
 	})
 
-	o.Spec("returns false for an empty token", func(t TV) {
+	o.Spec("returns unavailable for a 5xx", func(t TV) {
+		t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
+			StatusCode: 502,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		Expect(t, t.v.Validate("some-token").Status).To(Equal(capi.Unavailable))
+	})
+
+	o.Spec("returns invalid for an empty token", func(t TV) {
 		t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
 
-		Expect(t, t.v.Validate("")).To(BeFalse())
+		Expect(t, t.v.Validate("").Status).To(Equal(capi.Invalid))
+		Expect(t, t.spyDoer.reqs).To(HaveLen(0))
 	})
 
-	o.Spec("returns false if request fails", func(t TV) {
+	o.Spec("returns unavailable if request fails", func(t TV) {
 		t.spyDoer.err = errors.New("some-error")
 		t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
 			StatusCode: 200,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
 
-		Expect(t, t.v.Validate("some-token")).To(BeFalse())
+		Expect(t, t.v.Validate("some-token").Status).To(Equal(capi.Unavailable))
 	})
+
+	o.Spec("records CAPI requests by status", func(t TV) {
+		t.spyDoer.m["GET:http://some.url/v3/apps/some-id"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		t.v.Validate("some-token")
+
+		t.spyDoer.err = errors.New("some-error")
+		t.v.Validate("some-token")
+
+		Expect(t, t.spyMetrics.GetDelta("CAPIValidationRequests", "404")).To(Equal(uint64(1)))
+		Expect(t, t.spyMetrics.GetDelta("CAPIValidationRequests", "error")).To(Equal(uint64(1)))
+		Expect(t, t.spyMetrics.GetObservations("CAPIValidationLatencySeconds")).To(HaveLen(2))
+	})
+}
+
+type spyMetrics struct {
+	metrics.Metrics
+
+	mu sync.Mutex
+	m  map[string]uint64
+	o  map[string][]float64
+}
+
+func newSpyMetrics() *spyMetrics {
+	return &spyMetrics{
+		m: make(map[string]uint64),
+		o: make(map[string][]float64),
+	}
+}
+
+func (s *spyMetrics) NewLabeledCounter(name string, labels ...string) func(uint64, ...string) {
+	return func(delta uint64, labelValues ...string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.m[strings.Join(append([]string{name}, labelValues...), ":")] += delta
+	}
+}
+
+func (s *spyMetrics) NewHistogram(name string, buckets []float64) func(float64) {
+	return func(value float64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.o[name] = append(s.o[name], value)
+	}
+}
+
+func (s *spyMetrics) GetDelta(name string, labelValues ...string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[strings.Join(append([]string{name}, labelValues...), ":")]
+}
+
+func (s *spyMetrics) GetObservations(name string) []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.o[name]
 }
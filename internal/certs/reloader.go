@@ -0,0 +1,111 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Reloader serves a certificate and key pair from files. Diego rotates the
+// instance identity certificate in place, so the files are reloaded when
+// they change.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	log      logger.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewReloader loads the certificate and key. It returns an error if they
+// can not be loaded.
+func NewReloader(certFile, keyFile string, log logger.Logger) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the certificate and key if either file changed since they
+// were last loaded. The current certificate is kept if they can not be
+// loaded.
+func (r *Reloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+
+	r.log.Infof("loaded certificate %s", r.certFile)
+
+	return nil
+}
+
+// Run reloads the certificate every interval until the context is done.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := r.Reload(); err != nil {
+				r.log.Errorf("failed to reload certificate %s: %s", r.certFile, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
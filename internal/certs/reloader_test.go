@@ -0,0 +1,148 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/certs"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TR struct {
+	*testing.T
+	certFile string
+	keyFile  string
+	log      logger.Logger
+}
+
+func TestReloader(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TR {
+		dir, err := ioutil.TempDir("", "certs")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tr := TR{
+			T:        t,
+			certFile: filepath.Join(dir, "instance.crt"),
+			keyFile:  filepath.Join(dir, "instance.key"),
+			log:      logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		}
+		writeCert(t, tr.certFile, tr.keyFile, "some-cn", time.Now())
+
+		return tr
+	})
+
+	o.AfterEach(func(t TR) {
+		os.RemoveAll(filepath.Dir(t.certFile))
+	})
+
+	o.Spec("serves the certificate", func(t TR) {
+		r, err := certs.NewReloader(t.certFile, t.keyFile, t.log)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, commonName(t.T, r)).To(Equal("some-cn"))
+	})
+
+	o.Spec("returns an error if the certificate can not be loaded", func(t TR) {
+		_, err := certs.NewReloader("invalid", t.keyFile, t.log)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("reloads the certificate once the files change", func(t TR) {
+		r, err := certs.NewReloader(t.certFile, t.keyFile, t.log)
+		Expect(t, err).To(BeNil())
+
+		writeCert(t.T, t.certFile, t.keyFile, "other-cn", time.Now().Add(time.Minute))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go r.Run(ctx, time.Millisecond)
+
+		Expect(t, func() string {
+			return commonName(t.T, r)
+		}).To(ViaPolling(Equal("other-cn")))
+	})
+
+	o.Spec("keeps the current certificate if the files are invalid", func(t TR) {
+		r, err := certs.NewReloader(t.certFile, t.keyFile, t.log)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, ioutil.WriteFile(t.certFile, []byte("invalid"), 0600)).To(BeNil())
+		later := time.Now().Add(time.Minute)
+		Expect(t, os.Chtimes(t.certFile, later, later)).To(BeNil())
+
+		Expect(t, r.Reload()).To(Not(BeNil()))
+		Expect(t, commonName(t.T, r)).To(Equal("some-cn"))
+	})
+}
+
+func commonName(t *testing.T, r *certs.Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.Subject.CommonName
+}
+
+// writeCert writes a self-signed certificate and its key. The files' mod
+// times are set to the given time.
+func writeCert(t *testing.T, certFile, keyFile, cn string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// NewBackend returns a reverse proxy to the application at u. Requests that
+// can not reach the application (e.g., while it is starting) get a 503 with
+// a JSON body instead of a bare 502.
+func NewBackend(u *url.URL, rt http.RoundTripper, log logger.Logger) *httputil.ReverseProxy {
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.Transport = rt
+	rp.ErrorLog = logger.NewStdLogger(log)
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		var (
+			opErr  *net.OpError
+			netErr net.Error
+		)
+
+		switch {
+		case errors.Is(err, context.Canceled):
+			// The client went away; there is no one to respond to.
+			w.WriteHeader(http.StatusBadGateway)
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			log.Warnf("application is not reachable: %s", err)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "backend_unavailable", "the application is not accepting connections")
+		case errors.As(err, &netErr) && netErr.Timeout():
+			log.Warnf("application timed out: %s", err)
+			writeError(w, http.StatusGatewayTimeout, "backend_timeout", "the application did not respond in time")
+		default:
+			log.Errorf("failed to proxy request to application: %s", err)
+			writeError(w, http.StatusBadGateway, "backend_error", "the application's response could not be read")
+		}
+	}
+
+	return rp
+}
@@ -0,0 +1,91 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/transport"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TB struct {
+	*testing.T
+	recorder *httptest.ResponseRecorder
+	log      logger.Logger
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TB {
+		return TB{
+			T:        t,
+			recorder: httptest.NewRecorder(),
+			log:      logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		}
+	})
+
+	o.Spec("forwards requests to the application", func(t TB) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.URL.Path))
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		Expect(t, err).To(BeNil())
+
+		h := handlers.NewBackend(u, transport.New(transport.Config{}), t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "/some-path", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.recorder.Body.String()).To(Equal("/some-path"))
+	})
+
+	o.Spec("returns a 503 when the application is not reachable", func(t TB) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+
+		u, err := url.Parse(server.URL)
+		Expect(t, err).To(BeNil())
+
+		h := handlers.NewBackend(u, transport.New(transport.Config{}), t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "/", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("1"))
+
+		var body struct {
+			Error string `json:"error"`
+		}
+		Expect(t, json.Unmarshal(t.recorder.Body.Bytes(), &body)).To(BeNil())
+		Expect(t, body.Error).To(Equal("backend_unavailable"))
+	})
+
+	o.Spec("returns a 504 when the application times out", func(t TB) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		Expect(t, err).To(BeNil())
+
+		h := handlers.NewBackend(u, transport.New(transport.Config{
+			ResponseHeaderTimeout: 10 * time.Millisecond,
+		}), t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "/", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusGatewayTimeout))
+	})
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -10,15 +11,20 @@ type Controller struct {
 	r http.Handler
 }
 
+// NewController routes requests that match one of the open endpoints to
+// the whiteList handler and every other request to the other handler. It
+// panics if an open endpoint is invalid.
 func NewController(
-	whiteListPaths []string,
+	openEndpoints OpenEndpoints,
 	whiteList http.Handler,
 	other http.Handler,
 ) *Controller {
 	mux := mux.NewRouter()
 
-	for _, path := range whiteListPaths {
-		mux.Handle(path, whiteList)
+	for _, endpoint := range openEndpoints {
+		if err := endpoint.register(mux, whiteList); err != nil {
+			panic(fmt.Sprintf("invalid open endpoint %q: %s", endpoint.Path, err))
+		}
 	}
 
 	// catch-all
@@ -34,10 +34,16 @@ func TestController(t *testing.T) {
 			T:         t,
 			whitelist: whitelist,
 			other:     other,
-			c: handlers.NewController([]string{
-				"/great/{args}/still-good",
-				"/yay/{key}/{args}",
-				"/cool",
+			c: handlers.NewController(handlers.OpenEndpoints{
+				{Path: "/great/{args}/still-good"},
+				{Path: "/yay/{key}/{args}"},
+				{Path: "/cool"},
+				{Path: "/docs/", Match: "prefix"},
+				{Path: "/api", Match: "prefix"},
+				{Path: "/assets/*/*.css", Match: "glob"},
+				{Path: "/v[0-9]+/info", Match: "regex"},
+				{Path: "/health", Methods: []string{http.MethodGet}},
+				{Path: "/status", Host: "{sub}.other.url"},
 			}, whitelist, other),
 			recorder: httptest.NewRecorder(),
 		}
@@ -62,4 +68,90 @@ func TestController(t *testing.T) {
 		Expect(t, t.other.w).To(Not(BeNil()))
 		Expect(t, t.whitelist.r).To(BeNil())
 	})
+
+	o.Spec("routes by prefix, glob and regex", func(t TC) {
+		for path, open := range map[string]bool{
+			"/docs/":               true,
+			"/docs/a/b":            true,
+			"/docsa":               false,
+			"/api":                 true,
+			"/api/a":               true,
+			"/apisecret":           false,
+			"/assets/css/some.css": true,
+			"/assets/some.css":     false,
+			"/assets/css/some.js":  false,
+			"/v1/info":             true,
+			"/v12/info":            true,
+			"/v1/info/other":       false,
+			"/va/info":             false,
+		} {
+			whitelist, other := routedTo(t, http.MethodGet, "http://some.url"+path)
+			Expect(t, whitelist).To(Equal(open))
+			Expect(t, other).To(Equal(!open))
+		}
+	})
+
+	o.Spec("routes by method", func(t TC) {
+		whitelist, _ := routedTo(t, http.MethodGet, "http://some.url/health")
+		Expect(t, whitelist).To(BeTrue())
+
+		whitelist, other := routedTo(t, http.MethodPost, "http://some.url/health")
+		Expect(t, whitelist).To(BeFalse())
+		Expect(t, other).To(BeTrue())
+	})
+
+	o.Spec("routes by host", func(t TC) {
+		whitelist, _ := routedTo(t, http.MethodGet, "http://a.other.url/status")
+		Expect(t, whitelist).To(BeTrue())
+
+		whitelist, other := routedTo(t, http.MethodGet, "http://some.url/status")
+		Expect(t, whitelist).To(BeFalse())
+		Expect(t, other).To(BeTrue())
+	})
+
+	o.Spec("panics for an invalid open endpoint", func(t TC) {
+		Expect(t, func() {
+			handlers.NewController(handlers.OpenEndpoints{
+				{Path: "(", Match: "regex"},
+			}, t.whitelist, t.other)
+		}).To(Panic())
+
+		Expect(t, func() {
+			handlers.NewController(handlers.OpenEndpoints{
+				{Path: "/a", Match: "unknown"},
+			}, t.whitelist, t.other)
+		}).To(Panic())
+	})
+
+	o.Spec("reads open endpoints from a comma separated list", func(t TC) {
+		var e handlers.OpenEndpoints
+		Expect(t, e.UnmarshalEnv("/a, /b/{id}")).To(BeNil())
+		Expect(t, e).To(Equal(handlers.OpenEndpoints{
+			{Path: "/a"},
+			{Path: "/b/{id}"},
+		}))
+	})
+
+	o.Spec("reads open endpoints from JSON", func(t TC) {
+		var e handlers.OpenEndpoints
+		Expect(t, e.UnmarshalEnv(`[{"path": "/docs/**", "match": "glob", "methods": ["GET"], "host": "some.url"}]`)).To(BeNil())
+		Expect(t, e).To(Equal(handlers.OpenEndpoints{
+			{Path: "/docs/**", Match: "glob", Methods: []string{"GET"}, Host: "some.url"},
+		}))
+
+		Expect(t, e.UnmarshalEnv(`[{"path": "(", "match": "regex"}]`)).To(Not(BeNil()))
+		Expect(t, e.UnmarshalEnv(`[invalid`)).To(Not(BeNil()))
+	})
+}
+
+// routedTo reports which handler the request was routed to.
+func routedTo(t TC, method, url string) (whitelist, other bool) {
+	t.whitelist.r = nil
+	t.other.r = nil
+
+	req, err := http.NewRequest(method, url, nil)
+	Expect(t, err).To(BeNil())
+	t.c.ServeHTTP(httptest.NewRecorder(), req)
+
+	return t.whitelist.r != nil, t.other.r != nil
 }
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/poy/cf-space-security/internal/policy"
+)
+
+// OpenEndpoint describes requests that do not require auth.
+type OpenEndpoint struct {
+	// Path is matched according to Match.
+	Path string `json:"path"`
+
+	// Match is how the path is matched:
+	//   exact (default): gorilla/mux path template (e.g., /v1/{id})
+	//   prefix: Path and any path below it (e.g., /docs matches /docs/a but
+	//   not /docsecret)
+	//   glob: policy.MatchPath (e.g., /docs/**)
+	//   regex: regular expression matched against the whole path
+	Match string `json:"match"`
+
+	// Methods restricts the endpoint to the given methods. Any method is
+	// allowed if empty.
+	Methods []string `json:"methods"`
+
+	// Host restricts the endpoint to a gorilla/mux host template (e.g.,
+	// {subdomain}.some.url).
+	Host string `json:"host"`
+}
+
+// OpenEndpoints are a list of OpenEndpoint.
+type OpenEndpoints []OpenEndpoint
+
+// UnmarshalEnv reads either a JSON array of OpenEndpoint or a comma
+// separated list of exact paths.
+func (e *OpenEndpoints) UnmarshalEnv(data string) error {
+	data = strings.TrimSpace(data)
+	if data == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(data, "[") {
+		var endpoints OpenEndpoints
+		if err := json.Unmarshal([]byte(data), &endpoints); err != nil {
+			return fmt.Errorf("failed to parse open endpoints: %s", err)
+		}
+
+		for _, endpoint := range endpoints {
+			if _, err := endpoint.matcher(); err != nil {
+				return err
+			}
+		}
+
+		*e = endpoints
+		return nil
+	}
+
+	var endpoints OpenEndpoints
+	for _, path := range strings.Split(data, ",") {
+		endpoints = append(endpoints, OpenEndpoint{Path: strings.TrimSpace(path)})
+	}
+	*e = endpoints
+
+	return nil
+}
+
+// register adds the endpoint to the router.
+func (e OpenEndpoint) register(r *mux.Router, h http.Handler) error {
+	route := r.NewRoute()
+
+	m, err := e.matcher()
+	if err != nil {
+		return err
+	}
+	route = m(route)
+
+	if len(e.Methods) > 0 {
+		route = route.Methods(e.Methods...)
+	}
+
+	if e.Host != "" {
+		route = route.Host(e.Host)
+	}
+
+	route.Handler(h)
+	return route.GetError()
+}
+
+func (e OpenEndpoint) matcher() (func(*mux.Route) *mux.Route, error) {
+	switch strings.ToLower(e.Match) {
+	case "exact", "":
+		return func(r *mux.Route) *mux.Route { return r.Path(e.Path) }, nil
+	case "prefix":
+		// Match on segment boundaries so that /docs does not open
+		// /docsecret.
+		prefix := strings.TrimSuffix(e.Path, "/")
+		return func(r *mux.Route) *mux.Route {
+			return r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+				return req.URL.Path == prefix || strings.HasPrefix(req.URL.Path, prefix+"/")
+			})
+		}, nil
+	case "glob":
+		return func(r *mux.Route) *mux.Route {
+			return r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+				return policy.MatchPath(e.Path, req.URL.Path)
+			})
+		}, nil
+	case "regex":
+		re, err := regexp.Compile("^(?:" + e.Path + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid open endpoint regex %q: %s", e.Path, err)
+		}
+
+		return func(r *mux.Route) *mux.Route {
+			return r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+				return re.MatchString(req.URL.Path)
+			})
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown open endpoint match: %s", e.Match)
+	}
+}
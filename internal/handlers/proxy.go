@@ -2,18 +2,24 @@ package handlers
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/poy/cf-space-security/internal/accesslog"
 	"github.com/poy/cf-space-security/internal/cache"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/cf-space-security/internal/tracing"
 )
 
 type Proxy struct {
@@ -21,11 +27,20 @@ type Proxy struct {
 	m            map[string]bool
 	c            *cache.Cache
 	a            TokenAnalyzer
+	l            OutboundLimiter
+	retrier      Retrier
 	proxyCreator func(*http.Request) http.Handler
 
+	upstreamLatency   func(value float64, labelValues ...string)
+	tokenFetchLatency func(value float64)
+	requests          func(delta uint64, labelValues ...string)
+
+	accessLog AccessLogger
+	tracer    *tracing.Tracer
+
 	mu    sync.RWMutex
 	token string
-	log   *log.Logger
+	log   logger.Logger
 }
 
 type TokenFetcher interface {
@@ -48,31 +63,62 @@ func (f TokenAnalyzerFunc) Analyze(token string) bool {
 	return f(token)
 }
 
+// OutboundLimiter limits the requests made to each upstream host. Wait
+// blocks until a request can be made and returns a func that must be called
+// once it is done.
+type OutboundLimiter interface {
+	Wait(ctx context.Context, host string) (release func(), err error)
+}
+
+// Retrier wraps a RoundTripper so that failed requests are retried.
+type Retrier interface {
+	Wrap(http.RoundTripper) http.RoundTripper
+}
+
+// AccessLogger writes an entry for each request.
+type AccessLogger interface {
+	Log(accesslog.Entry)
+}
+
 type CacheCreator (func(r *http.Request) http.Handler)
 
 func NewProxy(
-	skipSSLValidation bool,
+	rt http.RoundTripper,
 	domains []string,
 	f TokenFetcher,
 	cacheCreator func(func(r *http.Request) http.Handler) *cache.Cache,
 	a TokenAnalyzer,
-	log *log.Logger,
+	l OutboundLimiter,
+	retrier Retrier,
+	m metrics.Metrics,
+	accessLog AccessLogger,
+	tracer *tracing.Tracer,
+	log logger.Logger,
 ) *Proxy {
-	m := make(map[string]bool)
+	domainMap := make(map[string]bool)
 	for _, domain := range domains {
-		m[domain] = true
+		domainMap[domain] = true
 	}
 
 	p := &Proxy{
-		f:     f,
-		m:     m,
-		a:     a,
-		token: f.Token(),
-		log:   log,
+		f:       f,
+		m:       domainMap,
+		a:       a,
+		l:       l,
+		retrier: retrier,
+		log:     log,
+
+		accessLog: accessLog,
+		tracer:    tracer,
+
+		upstreamLatency:   m.NewLabeledHistogram("UpstreamLatencySeconds", metrics.DefaultBuckets, "host", "status_class", "cache"),
+		tokenFetchLatency: m.NewHistogram("TokenFetchLatencySeconds", metrics.DefaultBuckets),
+		requests:          m.NewLabeledCounter("Requests", "host", "status_class"),
 	}
+	p.token = p.fetchToken(context.Background())
 
-	p.c = cacheCreator(p.createRevProxy(skipSSLValidation, true))
-	p.proxyCreator = p.createRevProxy(skipSSLValidation, false)
+	p.c = cacheCreator(p.createRevProxy(rt, true))
+	p.proxyCreator = p.createRevProxy(rt, false)
 
 	return p
 }
@@ -83,10 +129,38 @@ func (p *Proxy) CurrentToken() string {
 	return p.token
 }
 
+// CacheStats returns the stats of the GET cache.
+func (p *Proxy) CacheStats() cache.Stats {
+	return p.c.Stats()
+}
+
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	entry := accesslog.Entry{
+		Timestamp: start,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+	}
+	ctx, span := p.tracer.StartSpan(tracing.FromRequest(r), "proxy", tracing.Server)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.host", r.Host)
+
+	defer func() {
+		entry.Duration = time.Since(start).Seconds()
+		p.accessLog.Log(entry)
+
+		span.SetAttribute("http.status_code", entry.Status)
+		if entry.Status >= 500 {
+			span.SetError()
+		}
+		span.End()
+	}()
+
 	if r.Header.Get("Cache-Control") == "no-cache" {
 		if p.m[p.removeSubdomain(r.Host)] {
-			p.setAuth(r)
+			entry.TokenInjected, entry.TokenRefreshed = p.setAuth(ctx, r)
 		}
 
 		mw := &middleResponseWriter{
@@ -97,9 +171,17 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			mw.Flusher = f
 		}
 
+		upstreamSpan := p.startUpstreamSpan(ctx, r)
 		p.proxyCreator(r).ServeHTTP(mw, r)
+		endSpan(upstreamSpan, mw.statusCode)
+		p.observeUpstream(start, r.Host, mw.statusCode, "bypass")
+
+		entry.Cache = "bypass"
+		entry.Status = statusOrOK(mw.statusCode)
+		entry.Bytes = mw.bytes
 
-		if mw.statusCode == http.StatusUnauthorized {
+		// A 401 for the caller's own token says nothing about the proxy's.
+		if mw.statusCode == http.StatusUnauthorized && entry.TokenInjected {
 			p.clearToken()
 		}
 
@@ -112,6 +194,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var err error
 		body, err = ioutil.ReadAll(r.Body)
 		if err != nil {
+			entry.Status = http.StatusInternalServerError
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -119,6 +202,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var recorder *httptest.ResponseRecorder
 	defer func() {
+		entry.Status = recorder.Code
+		entry.Bytes = recorder.Body.Len()
+
 		for k, v := range recorder.Header() {
 			w.Header()[k] = v
 		}
@@ -130,6 +216,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		origHeaders := r.Header
 		r := *r
 		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
 
 		// Copy headers
 		r.Header = http.Header{}
@@ -145,10 +234,18 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if p.m[p.removeSubdomain(r.Host)] {
-			p.setAuth(&r)
-
-			p.c.ServeHTTP(mw, &r)
-			if mw.statusCode == http.StatusUnauthorized {
+			injected, refreshed := p.setAuth(ctx, &r)
+			entry.TokenInjected = entry.TokenInjected || injected
+			entry.TokenRefreshed = entry.TokenRefreshed || refreshed
+
+			_, cacheSpan := p.tracer.StartSpan(ctx, "cache_lookup", tracing.Internal)
+			tracing.Inject(cacheSpan.SpanContext(), r.Header)
+			cacheResult := p.c.Serve(mw, &r)
+			entry.Cache = cacheResult
+			cacheSpan.SetAttribute("cache.result", cacheResult)
+			endSpan(cacheSpan, mw.statusCode)
+			p.observeUpstream(start, r.Host, mw.statusCode, cacheResult)
+			if mw.statusCode == http.StatusUnauthorized && injected {
 				p.clearToken()
 				continue
 			}
@@ -156,30 +253,91 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		entry.Cache = "bypass"
+		upstreamSpan := p.startUpstreamSpan(ctx, &r)
 		p.proxyCreator(&r).ServeHTTP(mw, &r)
+		endSpan(upstreamSpan, mw.statusCode)
+		p.observeUpstream(start, r.Host, mw.statusCode, "bypass")
 		return
 	}
 }
 
-func (p *Proxy) setAuth(r *http.Request) {
-	if _, ok := r.Header["Authorization"]; !ok {
-		r.Header.Set("Authorization", p.getToken())
+// startUpstreamSpan starts a client span for the request and propagates it
+// via the request's headers.
+func (p *Proxy) startUpstreamSpan(ctx context.Context, r *http.Request) *tracing.Span {
+	_, span := p.tracer.StartSpan(ctx, "upstream", tracing.Client)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.host", r.Host)
+	tracing.Inject(span.SpanContext(), r.Header)
+
+	return span
+}
+
+func endSpan(s *tracing.Span, statusCode int) {
+	s.SetAttribute("http.status_code", statusOrOK(statusCode))
+	if statusCode >= 500 {
+		s.SetError()
+	}
+	s.End()
+}
+
+func (p *Proxy) observeUpstream(start time.Time, host string, statusCode int, cacheResult string) {
+	host = p.hostLabel(host)
+	p.upstreamLatency(time.Since(start).Seconds(), host, statusClass(statusCode), cacheResult)
+	p.requests(1, host, statusClass(statusCode))
+}
+
+// hostLabel returns the host's metric label. Hosts outside of the given
+// domains are counted as other to keep the number of labels bounded.
+func (p *Proxy) hostLabel(host string) string {
+	if p.m[host] || p.m[p.removeSubdomain(host)] {
+		return host
 	}
+
+	return metrics.OtherLabel
 }
 
-func (p *Proxy) getToken() string {
+// setAuth sets the Authorization header if the request does not already have
+// one. It reports whether it set the header and whether a new token had to be
+// fetched to do so.
+func (p *Proxy) setAuth(ctx context.Context, r *http.Request) (injected, refreshed bool) {
+	if _, ok := r.Header["Authorization"]; ok {
+		return false, false
+	}
+
+	token, refreshed := p.getToken(ctx)
+	r.Header.Set("Authorization", token)
+	return true, refreshed
+}
+
+func (p *Proxy) getToken(ctx context.Context) (token string, refreshed bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if p.token == "" {
-		p.token = p.f.Token()
+		p.log.Debugf("fetching new access token")
+		p.token = p.fetchToken(ctx)
+		refreshed = true
 	}
 
 	if p.a.Analyze(p.token) {
-		p.token = p.f.Token()
+		p.log.Debugf("access token expired, fetching new access token")
+		p.token = p.fetchToken(ctx)
+		refreshed = true
 	}
 
-	return p.token
+	return p.token, refreshed
+}
+
+func (p *Proxy) fetchToken(ctx context.Context) string {
+	_, span := p.tracer.StartSpan(ctx, "token_fetch", tracing.Internal)
+	start := time.Now()
+	defer func() {
+		p.tokenFetchLatency(time.Since(start).Seconds())
+		span.End()
+	}()
+
+	return p.f.Token()
 }
 
 func (p *Proxy) clearToken() {
@@ -188,24 +346,36 @@ func (p *Proxy) clearToken() {
 	p.token = ""
 }
 
-func (p *Proxy) createRevProxy(skipSSLValidation, useHTTPS bool) func(*http.Request) http.Handler {
-	return func(r *http.Request) http.Handler {
-		u, _ := url.Parse(r.URL.String())
-		u.Path = ""
-		if u.Scheme == "http" && useHTTPS {
-			u.Scheme = "https"
-		}
+// createRevProxy returns a reverse proxy that sends requests to the host of
+// their URL. Every request shares rt and therefore its connections.
+func (p *Proxy) createRevProxy(rt http.RoundTripper, useHTTPS bool) func(*http.Request) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			if r.URL.Scheme == "http" && useHTTPS {
+				r.URL.Scheme = "https"
+			}
 
-		rp := httputil.NewSingleHostReverseProxy(u)
-		rp.ErrorLog = p.log
+			if _, ok := r.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				r.Header.Set("User-Agent", "")
+			}
+		},
+		ErrorLog: logger.NewStdLogger(p.log),
 
-		rp.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipSSLValidation,
-			},
-		}
+		// Each retry waits for the OutboundLimiter again.
+		Transport: p.retrier.Wrap(&limitedTransport{rt: rt, l: p.l}),
 
-		rp.ModifyResponse = func(resp *http.Response) error {
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if err == ratelimit.ErrLimited {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			p.log.Errorf("http: proxy error: %s", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+
+		ModifyResponse: func(resp *http.Response) error {
 			if resp.StatusCode == http.StatusFound {
 				u, _ := url.Parse(resp.Header.Get("Location"))
 				if u != nil && p.m[p.removeSubdomain(u.Host)] {
@@ -214,8 +384,10 @@ func (p *Proxy) createRevProxy(skipSSLValidation, useHTTPS bool) func(*http.Requ
 			}
 
 			return nil
-		}
+		},
+	}
 
+	return func(*http.Request) http.Handler {
 		return rp
 	}
 }
@@ -229,11 +401,67 @@ func (p *Proxy) removeSubdomain(host string) string {
 	return domains[1]
 }
 
+// statusClass returns the class of the status code (e.g., 2xx).
+func statusClass(code int) string {
+	return fmt.Sprintf("%dxx", statusOrOK(code)/100)
+}
+
+// statusOrOK returns the status code. A handler that never calls WriteHeader
+// implies a 200.
+func statusOrOK(code int) int {
+	if code == 0 {
+		return http.StatusOK
+	}
+
+	return code
+}
+
+// limitedTransport waits for the OutboundLimiter before each request. The
+// request is done once its response body is closed.
+type limitedTransport struct {
+	rt http.RoundTripper
+	l  OutboundLimiter
+}
+
+func (t *limitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	release, err := t.l.Wait(r.Context(), r.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// Upgraded connections (e.g., websockets) need the original body and
+	// are not counted once established.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		release()
+		return resp, nil
+	}
+
+	resp.Body = &releaseCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (c *releaseCloser) Close() error {
+	defer c.release()
+	return c.ReadCloser.Close()
+}
+
 type middleResponseWriter struct {
 	http.ResponseWriter
 	http.Flusher
 
 	statusCode int
+	bytes      int
 }
 
 func (w *middleResponseWriter) WriteHeader(code int) {
@@ -243,6 +471,7 @@ func (w *middleResponseWriter) WriteHeader(code int) {
 
 func (w *middleResponseWriter) Write(data []byte) (int, error) {
 	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
 	if err != nil {
 		return n, err
 	}
@@ -1,18 +1,26 @@
 package handlers_test
 
 import (
+	"context"
+	"crypto/rand"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/poy/cf-space-security/internal/accesslog"
 	"github.com/poy/cf-space-security/internal/cache"
 	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/logger"
 	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/cf-space-security/internal/retry"
+	"github.com/poy/cf-space-security/internal/tracing"
+	"github.com/poy/cf-space-security/internal/transport"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
 	. "github.com/poy/onpar/matchers"
@@ -27,11 +35,17 @@ type TP struct {
 	server2     *httptest.Server
 	return401   bool
 	server1Data [][]byte
+	fail2       int
 
 	headers1 []http.Header
 	headers2 []http.Header
 	recorder *httptest.ResponseRecorder
 	p        *handlers.Proxy
+
+	spyMetrics      *spyMetrics
+	spyAccessLogger *spyAccessLogger
+	spyExporter     *spyExporter
+	spyLimiter      *spyOutboundLimiter
 }
 
 func TestProxy(t *testing.T) {
@@ -45,6 +59,10 @@ func TestProxy(t *testing.T) {
 			spyTokenFetcher:  newSpyTokenFetcher(),
 			spyTokenAnalyzer: newSpyTokenAnalyzler(),
 			recorder:         httptest.NewRecorder(),
+			spyMetrics:       newSpyMetrics(),
+			spyAccessLogger:  newSpyAccessLogger(),
+			spyExporter:      newSpyExporter(),
+			spyLimiter:       newSpyOutboundLimiter(),
 		}
 
 		tp.server1 = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -64,18 +82,33 @@ func TestProxy(t *testing.T) {
 
 		tp.server2 = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			tp.headers2 = append(tp.headers2, r.Header)
+
+			if tp.fail2 > 0 {
+				tp.fail2--
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
 		}))
 
 		tp.spyTokenFetcher.token = "some-token"
 		tp.p = handlers.NewProxy(
-			true,
+			transport.NewPool(transport.Config{SkipSSLValidation: true}),
 			[]string{tp.server1.URL[7:]},
 			tp.spyTokenFetcher,
 			func(f func(r *http.Request) http.Handler) *cache.Cache {
-				return cache.New(1, time.Minute, f, newSpyMetrics(), log.New(ioutil.Discard, "", 0))
+				return cache.New(1, time.Minute, f, newSpyMetrics(), logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
 			},
 			tp.spyTokenAnalyzer,
-			log.New(os.Stderr, "", 0),
+			tp.spyLimiter,
+			retry.New(retry.Policy{
+				MaxAttempts: 3,
+				BaseDelay:   time.Millisecond,
+				MaxDelay:    10 * time.Millisecond,
+				BudgetRatio: 0.2,
+			}, metrics.New(nil), logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
+			tp.spyMetrics,
+			tp.spyAccessLogger,
+			tracing.NewTracer(tp.spyExporter),
+			logger.New(os.Stderr, "", logger.Info, logger.Text),
 		)
 		return tp
 	})
@@ -168,6 +201,19 @@ func TestProxy(t *testing.T) {
 		Expect(t, t.spyTokenFetcher.called).To(Equal(2))
 	})
 
+	o.Spec("keeps its token on 401 for the caller's token", func(t *TP) {
+		t.return401 = true
+		req, err := http.NewRequest("GET", t.server1.URL, nil)
+		Expect(t, err).To(BeNil())
+		req.Host = "api." + t.server1.URL[7:]
+		req.Header.Set("Authorization", "my-token")
+		t.p.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.headers1).To(HaveLen(1))
+		Expect(t, t.spyTokenFetcher.called).To(Equal(1))
+	})
+
 	o.Spec("requests new token if it expires", func(t *TP) {
 		t.spyTokenAnalyzer.isExpired = true
 
@@ -225,11 +271,256 @@ func TestProxy(t *testing.T) {
 		}
 	})
 
+	o.Spec("records upstream latency with the cache result", func(t *TP) {
+		req, err := http.NewRequest("GET", t.server1.URL, nil)
+		Expect(t, err).To(BeNil())
+		req.Host = "api." + t.server1.URL[7:]
+		t.p.ServeHTTP(t.recorder, req)
+		t.p.ServeHTTP(httptest.NewRecorder(), req)
+
+		req, err = http.NewRequest("GET", t.server2.URL, nil)
+		Expect(t, err).To(BeNil())
+		t.p.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(t, t.spyMetrics.GetObservations("UpstreamLatencySeconds", "other", "2xx", "bypass")).To(HaveLen(1))
+		Expect(t, t.spyMetrics.GetObservations("UpstreamLatencySeconds", "api."+t.server1.URL[7:], "2xx", "miss")).To(HaveLen(1))
+		Expect(t, t.spyMetrics.GetObservations("UpstreamLatencySeconds", "api."+t.server1.URL[7:], "2xx", "hit")).To(HaveLen(1))
+	})
+
+	o.Spec("counts requests by host and status class", func(t *TP) {
+		t.return401 = true
+		req, err := http.NewRequest("GET", t.server1.URL, nil)
+		Expect(t, err).To(BeNil())
+		req.Host = "api." + t.server1.URL[7:]
+		t.p.ServeHTTP(t.recorder, req)
+
+		req, err = http.NewRequest("GET", t.server2.URL, nil)
+		Expect(t, err).To(BeNil())
+		t.p.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(t, t.spyMetrics.GetDelta("Requests", "api."+t.server1.URL[7:], "4xx")).To(Equal(uint64(2)))
+		Expect(t, t.spyMetrics.GetDelta("Requests", "other", "2xx")).To(Equal(uint64(1)))
+		Expect(t, t.spyMetrics.GetDelta("Requests", req.Host, "2xx")).To(Equal(uint64(0)))
+	})
+
+	o.Spec("records token fetch latency", func(t *TP) {
+		Expect(t, t.spyMetrics.GetObservations("TokenFetchLatencySeconds")).To(HaveLen(1))
+	})
+
+	o.Spec("writes an access log entry for each request", func(t *TP) {
+		req, err := http.NewRequest("GET", t.server1.URL+"/some-path?access_token=some-token", nil)
+		Expect(t, err).To(BeNil())
+		req.Host = "api." + t.server1.URL[7:]
+		t.p.ServeHTTP(t.recorder, req)
+		t.p.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := t.spyAccessLogger.getEntries()
+		Expect(t, entries).To(HaveLen(2))
+		Expect(t, entries[0].Method).To(Equal("GET"))
+		Expect(t, entries[0].Host).To(Equal("api." + t.server1.URL[7:]))
+		Expect(t, entries[0].Path).To(Equal("/some-path"))
+		Expect(t, entries[0].Status).To(Equal(http.StatusOK))
+		Expect(t, entries[0].Cache).To(Equal("miss"))
+		Expect(t, entries[0].TokenInjected).To(BeTrue())
+		Expect(t, entries[0].TokenRefreshed).To(BeFalse())
+		Expect(t, entries[1].Cache).To(Equal("hit"))
+	})
+
+	o.Spec("writes whether the token was refreshed to the access log", func(t *TP) {
+		t.return401 = true
+		req, err := http.NewRequest("GET", t.server1.URL, nil)
+		Expect(t, err).To(BeNil())
+		req.Host = "api." + t.server1.URL[7:]
+		t.p.ServeHTTP(t.recorder, req)
+
+		entries := t.spyAccessLogger.getEntries()
+		Expect(t, entries).To(HaveLen(1))
+		Expect(t, entries[0].Status).To(Equal(http.StatusUnauthorized))
+		Expect(t, entries[0].TokenRefreshed).To(BeTrue())
+	})
+
+	o.Spec("continues the incoming trace to the upstream", func(t *TP) {
+		req, err := http.NewRequest("GET", t.server2.URL, nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		t.p.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.headers2).To(HaveLen(1))
+		c, ok := tracing.Extract(t.headers2[0])
+		Expect(t, ok).To(BeTrue())
+		Expect(t, c.TraceIDString()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+
+		var spans []tracing.SpanData
+		for _, s := range t.spyExporter.getSpans() {
+			if s.SpanContext.TraceID == c.TraceID {
+				spans = append(spans, s)
+			}
+		}
+		Expect(t, spans).To(HaveLen(2))
+		Expect(t, spans[0].Name).To(Equal("upstream"))
+		Expect(t, spans[0].SpanContext.SpanID).To(Equal(c.SpanID))
+		Expect(t, spans[1].Name).To(Equal("proxy"))
+		Expect(t, spans[0].ParentSpanID).To(Equal(spans[1].SpanContext.SpanID))
+	})
+
+	o.Spec("records spans for the token fetch and cache lookup", func(t *TP) {
+		t.p.ServeHTTP(t.recorder, t.authorizedRequestWithTrace())
+		t.p.ServeHTTP(httptest.NewRecorder(), t.authorizedRequestWithTrace())
+
+		var names []string
+		for _, s := range t.spyExporter.getSpans() {
+			names = append(names, s.Name)
+		}
+		Expect(t, names).To(Contain("token_fetch", "cache_lookup", "proxy"))
+
+		// The trace headers are not part of the cache key
+		Expect(t, t.headers1).To(HaveLen(1))
+	})
+
+	o.Spec("waits for the outbound limiter before each upstream request", func(t *TP) {
+		req, err := http.NewRequest("GET", t.server2.URL, nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Cache-Control", "no-cache")
+		t.p.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.headers2).To(HaveLen(1))
+		Expect(t, t.spyLimiter.getHosts()).To(Equal([]string{"127.0.0.1"}))
+		Expect(t, t.spyLimiter.getReleased()).To(Equal(1))
+	})
+
+	o.Spec("returns a 429 if the outbound limit is exceeded", func(t *TP) {
+		t.spyLimiter.err = ratelimit.ErrLimited
+		req, err := http.NewRequest("GET", t.server2.URL, nil)
+		Expect(t, err).To(BeNil())
+		t.p.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(t, t.headers2).To(HaveLen(0))
+	})
+
+	o.Spec("retries idempotent requests that fail upstream", func(t *TP) {
+		t.fail2 = 2
+		req, err := http.NewRequest("GET", t.server2.URL, nil)
+		Expect(t, err).To(BeNil())
+		t.p.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.headers2).To(HaveLen(3))
+		Expect(t, t.spyLimiter.getHosts()).To(HaveLen(3))
+	})
+
+	o.Spec("does not retry non-idempotent requests", func(t *TP) {
+		t.fail2 = 1
+		req, err := http.NewRequest("POST", t.server2.URL, strings.NewReader("some-body"))
+		Expect(t, err).To(BeNil())
+		t.p.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.headers2).To(HaveLen(1))
+	})
+
 	o.Spec("it returns the current token", func(t *TP) {
 		Expect(t, t.p.CurrentToken()).To(Equal("some-token"))
 	})
 }
 
+func BenchmarkProxy(b *testing.B) {
+	b.Run("pooled transport", func(b *testing.B) {
+		benchmarkProxy(b, transport.NewPool(transport.Config{
+			SkipSSLValidation:   true,
+			MaxIdleConnsPerHost: 100,
+		}))
+	})
+
+	// A new transport for each request is how the proxy used to work.
+	b.Run("transport per request", func(b *testing.B) {
+		benchmarkProxy(b, roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			t := transport.New(transport.Config{SkipSSLValidation: true})
+			t.DisableKeepAlives = true
+			return t.RoundTrip(r)
+		}))
+	})
+}
+
+func benchmarkProxy(b *testing.B, rt http.RoundTripper) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("some-data"))
+	}))
+	defer server.Close()
+
+	log := logger.New(ioutil.Discard, "", logger.Error, logger.Text)
+	p := handlers.NewProxy(
+		rt,
+		nil,
+		handlers.TokenFetcherFunc(func() string { return "some-token" }),
+		func(f func(r *http.Request) http.Handler) *cache.Cache {
+			return cache.New(1, time.Minute, f, metrics.New(nil), log)
+		},
+		handlers.TokenAnalyzerFunc(func(string) bool { return false }),
+		ratelimit.NewHostLimiter(nil, 1, metrics.New(nil), log),
+		retry.New(retry.Policy{MaxAttempts: 1}, metrics.New(nil), log),
+		metrics.New(nil),
+		accesslog.New(ioutil.Discard, 0, log),
+		tracing.NewTracer(nil),
+		log,
+	)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("unexpected status code: %d", recorder.Code)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+type spyOutboundLimiter struct {
+	mu       sync.Mutex
+	hosts    []string
+	released int
+	err      error
+}
+
+func newSpyOutboundLimiter() *spyOutboundLimiter {
+	return &spyOutboundLimiter{}
+}
+
+func (s *spyOutboundLimiter) Wait(ctx context.Context, host string) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts = append(s.hosts, host)
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.released++
+	}, s.err
+}
+
+func (s *spyOutboundLimiter) getHosts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hosts
+}
+
+func (s *spyOutboundLimiter) getReleased() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.released
+}
+
 type spyTokenFetcher struct {
 	mu     sync.Mutex
 	called int
@@ -253,14 +544,39 @@ type spyMetrics struct {
 
 	mu sync.Mutex
 	m  map[string]uint64
+	o  map[string][]float64
 }
 
 func newSpyMetrics() *spyMetrics {
 	return &spyMetrics{
 		m: make(map[string]uint64),
+		o: make(map[string][]float64),
+	}
+}
+
+func (s *spyMetrics) NewHistogram(name string, buckets []float64) func(float64) {
+	return func(value float64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.o[name] = append(s.o[name], value)
 	}
 }
 
+func (s *spyMetrics) NewLabeledHistogram(name string, buckets []float64, labels ...string) func(float64, ...string) {
+	return func(value float64, labelValues ...string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		key := strings.Join(append([]string{name}, labelValues...), ":")
+		s.o[key] = append(s.o[key], value)
+	}
+}
+
+func (s *spyMetrics) GetObservations(name string, labelValues ...string) []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.o[strings.Join(append([]string{name}, labelValues...), ":")]
+}
+
 func (s *spyMetrics) NewCounter(name string) func(uint64) {
 	return func(delta uint64) {
 		s.mu.Lock()
@@ -269,10 +585,18 @@ func (s *spyMetrics) NewCounter(name string) func(uint64) {
 	}
 }
 
-func (s *spyMetrics) GetDelta(name string) uint64 {
+func (s *spyMetrics) NewLabeledCounter(name string, labels ...string) func(uint64, ...string) {
+	return func(delta uint64, labelValues ...string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.m[strings.Join(append([]string{name}, labelValues...), ":")] += delta
+	}
+}
+
+func (s *spyMetrics) GetDelta(name string, labelValues ...string) uint64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.m[name]
+	return s.m[strings.Join(append([]string{name}, labelValues...), ":")]
 }
 
 type spyTokenAnalyzer struct {
@@ -290,3 +614,58 @@ func (s *spyTokenAnalyzer) Analyze(token string) bool {
 
 	return s.isExpired
 }
+
+type spyAccessLogger struct {
+	mu      sync.Mutex
+	entries []accesslog.Entry
+}
+
+func newSpyAccessLogger() *spyAccessLogger {
+	return &spyAccessLogger{}
+}
+
+func (s *spyAccessLogger) Log(e accesslog.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+}
+
+func (s *spyAccessLogger) getEntries() []accesslog.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+func (t *TP) authorizedRequestWithTrace() *http.Request {
+	req, err := http.NewRequest("GET", t.server1.URL, nil)
+	Expect(t, err).To(BeNil())
+	req.Host = "api." + t.server1.URL[7:]
+
+	c := tracing.SpanContext{Sampled: true}
+	rand.Read(c.TraceID[:])
+	rand.Read(c.SpanID[:])
+	tracing.Inject(c, req.Header)
+
+	return req
+}
+
+type spyExporter struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func newSpyExporter() *spyExporter {
+	return &spyExporter{}
+}
+
+func (s *spyExporter) Export(d tracing.SpanData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, d)
+}
+
+func (s *spyExporter) getSpans() []tracing.SpanData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spans
+}
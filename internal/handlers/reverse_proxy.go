@@ -1,30 +1,293 @@
 package handlers
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/accesslog"
+	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/tracing"
 )
 
 type ReverseProxy struct {
-	v Validator
-	h http.Handler
+	v    Validator
+	a    Authorizer
+	f    IdentityForwarder
+	c    CertAuthenticator
+	mode AuthMode
+	l    RateLimiter
+	h    http.Handler
+
+	validationLatency func(value float64, labelValues ...string)
+	accessLog         AccessLogger
+	tracer            *tracing.Tracer
 }
 
 type Validator interface {
-	Validate(token string) bool
+	Validate(token string) capi.Result
 }
 
-func NewReverseProxy(h http.Handler, v Validator) *ReverseProxy {
+// Authorizer decides if a request with a valid token is allowed. If not, the
+// reason is returned. An error means the decision could not be made.
+type Authorizer interface {
+	Authorize(r *http.Request) (ok bool, reason string, err error)
+}
+
+// IdentityForwarder sets headers on an authorized request that describe who
+// made it.
+type IdentityForwarder interface {
+	Forward(r *http.Request)
+}
+
+// CertAuthenticator authenticates a request by its client certificate.
+type CertAuthenticator interface {
+	Authenticate(r *http.Request) (identity.Identity, error)
+}
+
+// RateLimiter decides if a validated request is within its caller's rate
+// limit. If not, it returns how long the caller should wait.
+type RateLimiter interface {
+	Allow(r *http.Request) (ok bool, retryAfter time.Duration)
+}
+
+// AuthMode is how requests are authenticated.
+type AuthMode int
+
+const (
+	// JWTAuth requires a valid token.
+	JWTAuth AuthMode = iota
+
+	// CertAuth requires an allowed client certificate.
+	CertAuth
+
+	// JWTOrCertAuth requires a valid token or an allowed client certificate.
+	JWTOrCertAuth
+
+	// JWTAndCertAuth requires a valid token and an allowed client
+	// certificate.
+	JWTAndCertAuth
+)
+
+// UnmarshalEnv implements envstruct.Unmarshaller.
+func (m *AuthMode) UnmarshalEnv(data string) error {
+	switch strings.ToLower(data) {
+	case "jwt", "":
+		*m = JWTAuth
+	case "mtls":
+		*m = CertAuth
+	case "jwt-or-mtls":
+		*m = JWTOrCertAuth
+	case "jwt-and-mtls":
+		*m = JWTAndCertAuth
+	default:
+		return fmt.Errorf("unknown auth mode: %s", data)
+	}
+
+	return nil
+}
+
+// unavailableRetryAfter is how long (in seconds) callers are asked to wait
+// when CAPI is unavailable.
+const unavailableRetryAfter = "5"
+
+func NewReverseProxy(
+	h http.Handler,
+	v Validator,
+	a Authorizer,
+	f IdentityForwarder,
+	c CertAuthenticator,
+	mode AuthMode,
+	l RateLimiter,
+	m metrics.Metrics,
+	accessLog AccessLogger,
+	tracer *tracing.Tracer,
+) *ReverseProxy {
 	return &ReverseProxy{
-		v: v,
-		h: h,
+		v:    v,
+		a:    a,
+		f:    f,
+		c:    c,
+		mode: mode,
+		l:    l,
+		h:    h,
+
+		validationLatency: m.NewLabeledHistogram("ValidationLatencySeconds", metrics.DefaultBuckets, "result"),
+		accessLog:         accessLog,
+		tracer:            tracer,
 	}
 }
 
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !p.v.Validate(r.Header.Get("Authorization")) {
-		w.WriteHeader(http.StatusUnauthorized)
+	start := time.Now()
+
+	ctx, span := p.tracer.StartSpan(tracing.FromRequest(r), "reverse_proxy", tracing.Server)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.host", r.Host)
+
+	_, validationSpan := p.tracer.StartSpan(ctx, "validation", tracing.Internal)
+
+	var certErr error
+	if p.mode != JWTAuth {
+		var i identity.Identity
+		i, certErr = p.c.Authenticate(r)
+		if certErr == nil {
+			ctx = identity.NewContext(ctx, i)
+		}
+	}
+
+	// A token is validated whenever one is given so that it can be trusted
+	// further down (e.g., for identity headers).
+	token := r.Header.Get("Authorization")
+	validation := capi.Result{Status: capi.Valid}
+	result := "certificate"
+	switch {
+	case (p.mode == CertAuth || p.mode == JWTAndCertAuth) && certErr != nil:
+		validation = capi.Result{Status: capi.Invalid, Reason: certErr.Error()}
+		result = "invalid_certificate"
+	case p.mode == JWTAuth || p.mode == JWTAndCertAuth || certErr != nil || token != "":
+		validation = p.v.Validate(token)
+		result = validation.Status.String()
+	}
+
+	p.validationLatency(time.Since(start).Seconds(), result)
+	validationSpan.SetAttribute("validation.result", result)
+	validationSpan.End()
+
+	mw := &statusRecorder{
+		ResponseWriter: w,
+	}
+
+	defer func() {
+		p.accessLog.Log(accesslog.Entry{
+			Timestamp:  start,
+			Method:     r.Method,
+			Host:       r.Host,
+			Path:       r.URL.Path,
+			Status:     statusOrOK(mw.statusCode),
+			Duration:   time.Since(start).Seconds(),
+			Bytes:      mw.bytes,
+			Validation: result,
+		})
+
+		endSpan(span, mw.statusCode)
+	}()
+
+	switch validation.Status {
+	case capi.Valid:
+	case capi.Forbidden:
+		writeError(mw, http.StatusForbidden, "forbidden", validation.Reason)
+		return
+	case capi.Unavailable:
+		mw.Header().Set("Retry-After", unavailableRetryAfter)
+		writeError(mw, http.StatusServiceUnavailable, "unavailable", validation.Reason)
+		return
+	default:
+		if result == "invalid_certificate" {
+			writeError(mw, http.StatusUnauthorized, "invalid_client_certificate", validation.Reason)
+			return
+		}
+
+		// RFC 6750: a request without a token does not get an error code.
+		if token == "" {
+			mw.Header().Set("WWW-Authenticate", "Bearer")
+		} else {
+			mw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		writeError(mw, http.StatusUnauthorized, "invalid_token", validation.Reason)
+		return
+	}
+
+	r = r.WithContext(ctx)
+
+	// Callers are only keyed by their validated identity: a forged token
+	// must not use up (or escape) another caller's limit.
+	if ok, retryAfter := p.l.Allow(r); !ok {
+		result = "rate_limited"
+		mw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeError(mw, http.StatusTooManyRequests, "rate_limited", "rate limit exceeded")
 		return
 	}
 
-	p.h.ServeHTTP(w, r)
+	_, authSpan := p.tracer.StartSpan(ctx, "authorization", tracing.Internal)
+	ok, reason, err := p.a.Authorize(r)
+	authSpan.SetAttribute("authorization.allowed", ok)
+	authSpan.End()
+
+	if err != nil {
+		result = "unavailable"
+		mw.Header().Set("Retry-After", unavailableRetryAfter)
+		writeError(mw, http.StatusServiceUnavailable, "unavailable", err.Error())
+		return
+	}
+
+	if !ok {
+		result = "forbidden"
+		writeError(mw, http.StatusForbidden, "forbidden", reason)
+		return
+	}
+
+	p.f.Forward(r)
+
+	_, upstreamSpan := p.tracer.StartSpan(ctx, "upstream", tracing.Client)
+	tracing.Inject(upstreamSpan.SpanContext(), r.Header)
+	p.h.ServeHTTP(mw, r)
+	endSpan(upstreamSpan, mw.statusCode)
+}
+
+// writeError writes a JSON error body with the given status code.
+func writeError(w http.ResponseWriter, code int, errType, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason,omitempty"`
+	}{
+		Error:  errType,
+		Reason: reason,
+	})
+}
+
+// statusRecorder records the status code and number of bytes written while
+// still exposing the Flusher and Hijacker of the underlying ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	statusCode int
+	bytes      int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.statusCode = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying ResponseWriter is not a Hijacker")
+	}
+
+	return h.Hijack()
 }
@@ -1,11 +1,21 @@
 package handlers_test
 
 import (
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/capi"
 	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/cf-space-security/internal/tracing"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
 	. "github.com/poy/onpar/matchers"
@@ -13,11 +23,19 @@ import (
 
 type TR struct {
 	*testing.T
-	spyValidator *spyValidator
-	r            http.Handler
-	recorder     *httptest.ResponseRecorder
+	spyValidator  *spyValidator
+	spyAuthorizer *spyAuthorizer
+	spyForwarder  *spyForwarder
+	spyCertAuth   *spyCertAuthenticator
+	spyLimiter    *spyRateLimiter
+	withMode      func(handlers.AuthMode) http.Handler
+	r             http.Handler
+	recorder      *httptest.ResponseRecorder
 
-	spyHandler *spyHandler
+	spyHandler      *spyHandler
+	spyMetrics      *spyMetrics
+	spyAccessLogger *spyAccessLogger
+	spyExporter     *spyExporter
 }
 
 func TestReverseProxy(t *testing.T) {
@@ -27,18 +45,57 @@ func TestReverseProxy(t *testing.T) {
 
 	o.BeforeEach(func(t *testing.T) TR {
 		spyValidator := newSpyValidator()
+		spyAuthorizer := newSpyAuthorizer()
+		spyForwarder := newSpyForwarder()
+		spyCertAuth := newSpyCertAuthenticator()
+		spyLimiter := newSpyRateLimiter()
 		spyHandler := newSpyHandler()
+		spyMetrics := newSpyMetrics()
+		spyAccessLogger := newSpyAccessLogger()
+		spyExporter := newSpyExporter()
 		return TR{
-			T:            t,
-			spyValidator: spyValidator,
-			recorder:     httptest.NewRecorder(),
-			spyHandler:   spyHandler,
-			r:            handlers.NewReverseProxy(spyHandler, spyValidator),
+			T:               t,
+			spyValidator:    spyValidator,
+			spyAuthorizer:   spyAuthorizer,
+			spyForwarder:    spyForwarder,
+			spyCertAuth:     spyCertAuth,
+			spyLimiter:      spyLimiter,
+			recorder:        httptest.NewRecorder(),
+			spyHandler:      spyHandler,
+			spyMetrics:      spyMetrics,
+			spyAccessLogger: spyAccessLogger,
+			spyExporter:     spyExporter,
+			r: handlers.NewReverseProxy(
+				spyHandler,
+				spyValidator,
+				spyAuthorizer,
+				spyForwarder,
+				spyCertAuth,
+				handlers.JWTAuth,
+				spyLimiter,
+				spyMetrics,
+				spyAccessLogger,
+				tracing.NewTracer(spyExporter),
+			),
+			withMode: func(mode handlers.AuthMode) http.Handler {
+				return handlers.NewReverseProxy(
+					spyHandler,
+					spyValidator,
+					spyAuthorizer,
+					spyForwarder,
+					spyCertAuth,
+					mode,
+					spyLimiter,
+					spyMetrics,
+					spyAccessLogger,
+					tracing.NewTracer(nil),
+				)
+			},
 		}
 	})
 
 	o.Spec("it passes request to correct proxy", func(t TR) {
-		t.spyValidator.result = true
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
 		req, err := http.NewRequest("GET", "http://some.url", nil)
 		Expect(t, err).To(BeNil())
 		req.Header.Set("Authorization", "some-token")
@@ -60,22 +117,408 @@ func TestReverseProxy(t *testing.T) {
 		Expect(t, t.spyHandler.r).To(BeNil())
 		Expect(t, t.spyHandler.w).To(BeNil())
 	})
+
+	o.Spec("it returns a 401 with WWW-Authenticate for an invalid token", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Invalid, Reason: "some-reason"}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "some-token")
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.recorder.Header().Get("WWW-Authenticate")).To(Equal(`Bearer error="invalid_token"`))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"invalid_token","reason":"some-reason"}`))
+	})
+
+	o.Spec("it returns a 401 without an error code for a missing token", func(t TR) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.recorder.Header().Get("WWW-Authenticate")).To(Equal("Bearer"))
+	})
+
+	o.Spec("it returns a 403 if the token does not have access to the app", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Forbidden, Reason: "some-reason"}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "some-token")
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"forbidden","reason":"some-reason"}`))
+		Expect(t, t.spyHandler.r).To(BeNil())
+		Expect(t, t.spyAuthorizer.r).To(BeNil())
+		Expect(t, t.spyAccessLogger.getEntries()[0].Validation).To(Equal("forbidden"))
+	})
+
+	o.Spec("it returns a 503 if the token could not be validated", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Unavailable, Reason: "some-reason"}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "some-token")
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("5"))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"unavailable","reason":"some-reason"}`))
+		Expect(t, t.spyHandler.r).To(BeNil())
+		Expect(t, t.spyMetrics.GetObservations("ValidationLatencySeconds", "unavailable")).To(HaveLen(1))
+	})
+
+	o.Spec("it returns a 403 with the reason if the authorizer denies the request", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		t.spyAuthorizer.ok = false
+		t.spyAuthorizer.reason = "some-reason"
+		req, err := http.NewRequest("POST", "http://some.url/some-path", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"forbidden","reason":"some-reason"}`))
+		Expect(t, t.spyAuthorizer.r.URL.Path).To(Equal("/some-path"))
+		Expect(t, t.spyHandler.r).To(BeNil())
+
+		entries := t.spyAccessLogger.getEntries()
+		Expect(t, entries).To(HaveLen(1))
+		Expect(t, entries[0].Validation).To(Equal("forbidden"))
+	})
+
+	o.Spec("it returns a 503 if the authorizer can not decide", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		t.spyAuthorizer.ok = false
+		t.spyAuthorizer.err = errors.New("some-error")
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("5"))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"unavailable","reason":"some-error"}`))
+		Expect(t, t.spyHandler.r).To(BeNil())
+		Expect(t, t.spyAccessLogger.getEntries()[0].Validation).To(Equal("unavailable"))
+	})
+
+	o.Spec("it forwards the identity of authorized requests", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.spyForwarder.r).To(Not(BeNil()))
+		Expect(t, t.spyHandler.r.Header.Get("X-CF-User-ID")).To(Equal("some-user"))
+
+		t.spyForwarder.r = nil
+		t.spyAuthorizer.ok = false
+		t.r.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(t, t.spyForwarder.r).To(BeNil())
+	})
+
+	o.Spec("it returns a 429 if the caller is rate limited", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		t.spyLimiter.ok = false
+		t.spyLimiter.retryAfter = 1500 * time.Millisecond
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("2"))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"rate_limited","reason":"rate limit exceeded"}`))
+		Expect(t, t.spyHandler.r).To(BeNil())
+		Expect(t, t.spyForwarder.r).To(BeNil())
+	})
+
+	o.Spec("it only rate limits validated requests", func(t TR) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "some-token")
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.spyLimiter.r).To(BeNil())
+
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		t.spyLimiter.ok = false
+		t.recorder = httptest.NewRecorder()
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(t, t.spyAuthorizer.r).To(BeNil())
+		Expect(t, t.spyAccessLogger.getEntries()[1].Validation).To(Equal("rate_limited"))
+	})
+
+	o.Spec("a forged token does not use up another caller's limit", func(t TR) {
+		victim := newToken(t.T, "some-key", jwt.MapClaims{"user_id": "some-user"})
+		forged := newToken(t.T, "other-key", jwt.MapClaims{"user_id": "some-user"})
+
+		log := logger.New(ioutil.Discard, "", logger.Error, logger.Text)
+		r := handlers.NewReverseProxy(
+			t.spyHandler,
+			tokenValidator{victim: capi.Result{Status: capi.Valid}},
+			t.spyAuthorizer,
+			t.spyForwarder,
+			t.spyCertAuth,
+			handlers.JWTAuth,
+			ratelimit.New(ratelimit.Rules{{Path: "/**", Key: "user_id", Rate: 0.001, Burst: 1}}, 10, metrics.New(nil), log),
+			t.spyMetrics,
+			t.spyAccessLogger,
+			tracing.NewTracer(nil),
+		)
+
+		for i := 0; i < 3; i++ {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://some.url", nil)
+			req.Header.Set("Authorization", forged)
+			r.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+		}
+
+		req := httptest.NewRequest("GET", "http://some.url", nil)
+		req.Header.Set("Authorization", victim)
+		r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it does not authorize invalid tokens", func(t TR) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.spyAuthorizer.r).To(BeNil())
+	})
+
+	o.Spec("it does not look at client certificates in JWT mode", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.spyCertAuth.r).To(BeNil())
+	})
+
+	o.Spec("it accepts allowed client certificates in mTLS mode", func(t TR) {
+		t.spyCertAuth.identity = identity.Identity{AppID: "some-app"}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.withMode(handlers.CertAuth).ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyValidator.called).To(BeFalse())
+
+		i, ok := identity.FromContext(t.spyForwarder.r.Context())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, i.AppID).To(Equal("some-app"))
+		Expect(t, t.spyAccessLogger.getEntries()[0].Validation).To(Equal("certificate"))
+	})
+
+	o.Spec("it rejects requests without an allowed client certificate in mTLS mode", func(t TR) {
+		t.spyCertAuth.err = errors.New("some-error")
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "some-token")
+		t.withMode(handlers.CertAuth).ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"error":"invalid_client_certificate","reason":"some-error"}`))
+		Expect(t, t.spyHandler.r).To(BeNil())
+	})
+
+	o.Spec("it validates tokens sent with a client certificate", func(t TR) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "some-token")
+		t.withMode(handlers.CertAuth).ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.spyValidator.token).To(Equal("some-token"))
+	})
+
+	o.Spec("it accepts a token or a client certificate", func(t TR) {
+		h := t.withMode(handlers.JWTOrCertAuth)
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		t.spyCertAuth.err = errors.New("some-error")
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		req.Header.Set("Authorization", "some-token")
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		t.spyValidator.result = capi.Result{Status: capi.Invalid}
+		recorder = httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("it requires a token and a client certificate", func(t TR) {
+		h := t.withMode(handlers.JWTAndCertAuth)
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(t, t.spyValidator.called).To(BeTrue())
+
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		t.spyCertAuth.err = errors.New("some-error")
+		recorder = httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("it reads the auth mode", func(t TR) {
+		var m handlers.AuthMode
+		Expect(t, m.UnmarshalEnv("mtls")).To(BeNil())
+		Expect(t, m).To(Equal(handlers.CertAuth))
+		Expect(t, m.UnmarshalEnv("jwt-or-mtls")).To(BeNil())
+		Expect(t, m).To(Equal(handlers.JWTOrCertAuth))
+		Expect(t, m.UnmarshalEnv("jwt-and-mtls")).To(BeNil())
+		Expect(t, m).To(Equal(handlers.JWTAndCertAuth))
+		Expect(t, m.UnmarshalEnv("jwt")).To(BeNil())
+		Expect(t, m).To(Equal(handlers.JWTAuth))
+		Expect(t, m.UnmarshalEnv("invalid")).To(Not(BeNil()))
+	})
+
+	o.Spec("it records validation latency", func(t TR) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		t.r.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(t, t.spyMetrics.GetObservations("ValidationLatencySeconds", "invalid")).To(HaveLen(1))
+		Expect(t, t.spyMetrics.GetObservations("ValidationLatencySeconds", "valid")).To(HaveLen(1))
+	})
+
+	o.Spec("it writes an access log entry for each request", func(t TR) {
+		req, err := http.NewRequest("POST", "http://some.url/some-path", nil)
+		Expect(t, err).To(BeNil())
+		t.r.ServeHTTP(t.recorder, req)
+
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		t.r.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := t.spyAccessLogger.getEntries()
+		Expect(t, entries).To(HaveLen(2))
+		Expect(t, entries[0].Method).To(Equal("POST"))
+		Expect(t, entries[0].Host).To(Equal("some.url"))
+		Expect(t, entries[0].Path).To(Equal("/some-path"))
+		Expect(t, entries[0].Status).To(Equal(http.StatusUnauthorized))
+		Expect(t, entries[0].Validation).To(Equal("invalid"))
+		Expect(t, entries[1].Status).To(Equal(http.StatusOK))
+		Expect(t, entries[1].Validation).To(Equal("valid"))
+	})
+
+	o.Spec("it continues the incoming trace to the backend", func(t TR) {
+		t.spyValidator.result = capi.Result{Status: capi.Valid}
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-B3-TraceId", "4bf92f3577b34da6a3ce929d0e0e4736")
+		req.Header.Set("X-B3-SpanId", "00f067aa0ba902b7")
+		t.r.ServeHTTP(t.recorder, req)
+
+		c, ok := tracing.Extract(t.spyHandler.r.Header)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, c.TraceIDString()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+
+		spans := t.spyExporter.getSpans()
+		Expect(t, spans).To(HaveLen(4))
+		Expect(t, spans[0].Name).To(Equal("validation"))
+		Expect(t, spans[1].Name).To(Equal("authorization"))
+		Expect(t, spans[2].Name).To(Equal("upstream"))
+		Expect(t, spans[2].SpanContext.SpanID).To(Equal(c.SpanID))
+		Expect(t, spans[3].Name).To(Equal("reverse_proxy"))
+		Expect(t, spans[3].ParentSpanID).To(Equal([8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}))
+	})
 }
 
 type spyValidator struct {
-	result bool
+	result capi.Result
 	token  string
+	called bool
 }
 
 func newSpyValidator() *spyValidator {
-	return &spyValidator{}
+	return &spyValidator{
+		result: capi.Result{Status: capi.Invalid},
+	}
 }
 
-func (s *spyValidator) Validate(token string) bool {
+func (s *spyValidator) Validate(token string) capi.Result {
+	s.called = true
 	s.token = token
 	return s.result
 }
 
+type spyAuthorizer struct {
+	ok     bool
+	reason string
+	err    error
+	r      *http.Request
+}
+
+func newSpyAuthorizer() *spyAuthorizer {
+	return &spyAuthorizer{ok: true}
+}
+
+func (s *spyAuthorizer) Authorize(r *http.Request) (bool, string, error) {
+	s.r = r
+	return s.ok, s.reason, s.err
+}
+
+type spyForwarder struct {
+	r *http.Request
+}
+
+func newSpyForwarder() *spyForwarder {
+	return &spyForwarder{}
+}
+
+func (s *spyForwarder) Forward(r *http.Request) {
+	s.r = r
+	r.Header.Set("X-CF-User-ID", "some-user")
+}
+
+type spyCertAuthenticator struct {
+	identity identity.Identity
+	err      error
+	r        *http.Request
+}
+
+func newSpyCertAuthenticator() *spyCertAuthenticator {
+	return &spyCertAuthenticator{}
+}
+
+func (s *spyCertAuthenticator) Authenticate(r *http.Request) (identity.Identity, error) {
+	s.r = r
+	return s.identity, s.err
+}
+
+type spyRateLimiter struct {
+	ok         bool
+	retryAfter time.Duration
+	r          *http.Request
+}
+
+func newSpyRateLimiter() *spyRateLimiter {
+	return &spyRateLimiter{ok: true}
+}
+
+func (s *spyRateLimiter) Allow(r *http.Request) (bool, time.Duration) {
+	s.r = r
+	return s.ok, s.retryAfter
+}
+
 type spyHandler struct {
 	w http.ResponseWriter
 	r *http.Request
@@ -89,3 +532,24 @@ func (s *spyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.w = w
 	s.r = r
 }
+
+// tokenValidator returns the result for each known token. Other tokens are
+// invalid.
+type tokenValidator map[string]capi.Result
+
+func (v tokenValidator) Validate(token string) capi.Result {
+	if r, ok := v[token]; ok {
+		return r
+	}
+
+	return capi.Result{Status: capi.Invalid}
+}
+
+func newToken(t *testing.T, key string, c jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "bearer " + token
+}
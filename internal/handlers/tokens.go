@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// TokenSource returns the access token the proxy currently holds.
+type TokenSource interface {
+	CurrentToken() string
+}
+
+// Tokens serves the current access token along with when it expires and
+// its scopes.
+type Tokens struct {
+	s      TokenSource
+	secret string
+	log    logger.Logger
+}
+
+// NewTokens returns a new Tokens. If the secret is set, requests must have
+// it as their bearer token.
+func NewTokens(s TokenSource, secret string, log logger.Logger) *Tokens {
+	return &Tokens{
+		s:      s,
+		secret: secret,
+		log:    log,
+	}
+}
+
+func (t *Tokens) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "")
+		return
+	}
+
+	if t.secret != "" && !t.authorized(r.Header.Get("Authorization")) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid or missing secret")
+		return
+	}
+
+	token := t.s.CurrentToken()
+	if token == "" {
+		writeError(w, http.StatusServiceUnavailable, "unavailable", "no access token")
+		return
+	}
+
+	resp := struct {
+		AccessToken string   `json:"access_token"`
+		ExpiresAt   string   `json:"expires_at,omitempty"`
+		ExpiresIn   int64    `json:"expires_in,omitempty"`
+		Scopes      []string `json:"scopes,omitempty"`
+	}{
+		AccessToken: token,
+	}
+
+	i, err := identity.FromToken(token)
+	if err != nil {
+		t.log.Warnf("failed to read access token claims: %s", err)
+	}
+
+	if !i.ExpiresAt.IsZero() {
+		resp.ExpiresAt = i.ExpiresAt.UTC().Format(time.RFC3339)
+		resp.ExpiresIn = int64(time.Until(i.ExpiresAt).Seconds())
+	}
+	resp.Scopes = i.Scopes
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authorized reports whether the header has the secret as its bearer token.
+// The scheme is case-insensitive (RFC 7235).
+func (t *Tokens) authorized(header string) bool {
+	const prefix = "Bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(t.secret)) == 1
+}
@@ -0,0 +1,114 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TT struct {
+	*testing.T
+	spyTokenSource *spyTokenSource
+	recorder       *httptest.ResponseRecorder
+	log            logger.Logger
+}
+
+func TestTokens(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TT {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"scope": []string{"cloud_controller.read", "openid"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}).SignedString([]byte("some-key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return TT{
+			T:              t,
+			spyTokenSource: &spyTokenSource{token: "bearer " + token},
+			recorder:       httptest.NewRecorder(),
+			log:            logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		}
+	})
+
+	o.Spec("returns the token with its expiry and scopes", func(t TT) {
+		h := handlers.NewTokens(t.spyTokenSource, "", t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "/tokens", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.recorder.Header().Get("Cache-Control")).To(Equal("no-store"))
+
+		var resp struct {
+			AccessToken string   `json:"access_token"`
+			ExpiresAt   string   `json:"expires_at"`
+			ExpiresIn   int64    `json:"expires_in"`
+			Scopes      []string `json:"scopes"`
+		}
+		Expect(t, json.Unmarshal(t.recorder.Body.Bytes(), &resp)).To(BeNil())
+		Expect(t, resp.AccessToken).To(Equal(t.spyTokenSource.token))
+		Expect(t, resp.ExpiresAt).To(Not(Equal("")))
+		Expect(t, resp.ExpiresIn > 3500 && resp.ExpiresIn <= 3600).To(BeTrue())
+		Expect(t, resp.Scopes).To(Equal([]string{"cloud_controller.read", "openid"}))
+	})
+
+	o.Spec("requires the secret if one is set", func(t TT) {
+		h := handlers.NewTokens(t.spyTokenSource, "some-secret", t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "/tokens", nil))
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		t.recorder = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tokens", nil)
+		req.Header.Set("Authorization", "Bearer other-secret")
+		h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		t.recorder = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/tokens", nil)
+		req.Header.Set("Authorization", "Bearer some-secret")
+		h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		t.recorder = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/tokens", nil)
+		req.Header.Set("Authorization", "bearer some-secret")
+		h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("returns a 503 without a token", func(t TT) {
+		t.spyTokenSource.token = ""
+		h := handlers.NewTokens(t.spyTokenSource, "", t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "/tokens", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	o.Spec("only allows GET", func(t TT) {
+		h := handlers.NewTokens(t.spyTokenSource, "", t.log)
+		h.ServeHTTP(t.recorder, httptest.NewRequest("POST", "/tokens", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+}
+
+type spyTokenSource struct {
+	token string
+}
+
+func (s *spyTokenSource) CurrentToken() string {
+	return s.token
+}
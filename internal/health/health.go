@@ -0,0 +1,164 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status is the result of a check.
+type Status struct {
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// CheckFunc reports on a dependency.
+type CheckFunc func(ctx context.Context) Status
+
+// Health reports the results of its checks. Liveness (/health) succeeds as
+// long as the process is serving while readiness (/ready) runs the checks and
+// fails if any of them does.
+type Health struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	checks []check
+}
+
+type check struct {
+	name string
+	f    CheckFunc
+}
+
+// New returns a Health whose checks are each given the timeout.
+func New(timeout time.Duration) *Health {
+	return &Health{
+		timeout: timeout,
+	}
+}
+
+// Add adds a check.
+func (h *Health) Add(name string, f CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, check{name: name, f: f})
+}
+
+// Liveness returns a handler for /health.
+// It does not run the checks so that a slow dependency does not get the
+// process restarted.
+func (h *Health) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusOK, "ok", nil)
+	})
+}
+
+// Readiness returns a handler for /ready.
+func (h *Health) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ok := h.run(r.Context())
+
+		if !ok {
+			writeStatus(w, http.StatusServiceUnavailable, "unavailable", results)
+			return
+		}
+		writeStatus(w, http.StatusOK, "ok", results)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, code int, status string, checks map[string]Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]Status `json:"checks,omitempty"`
+	}{
+		Status: status,
+		Checks: checks,
+	})
+}
+
+// run runs every check concurrently.
+func (h *Health) run(ctx context.Context) (map[string]Status, bool) {
+	h.mu.Lock()
+	checks := h.checks
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	statuses := make([]Status, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			statuses[i] = c.f(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	results := make(map[string]Status, len(checks))
+	ok := true
+	for i, c := range checks {
+		results[c.name] = statuses[i]
+		ok = ok && statuses[i].OK
+	}
+
+	return results, ok
+}
+
+// Doer is used to make HTTP requests.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// HTTPCheck checks that the URL can be reached and does not respond with a
+// 5xx.
+func HTTPCheck(d Doer, url string) CheckFunc {
+	return func(ctx context.Context) Status {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return Status{Error: err.Error()}
+		}
+
+		resp, err := d.Do(req.WithContext(ctx))
+		if err != nil {
+			return Status{Error: err.Error()}
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			return Status{Error: fmt.Sprintf("unexpected status code: %d", resp.StatusCode)}
+		}
+
+		return Status{OK: true}
+	}
+}
+
+// DialCheck checks that a connection can be made to the address.
+func DialCheck(network, addr string) CheckFunc {
+	return func(ctx context.Context) Status {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return Status{Error: err.Error()}
+		}
+		conn.Close()
+
+		return Status{OK: true}
+	}
+}
+
+// Info always succeeds and reports the details.
+func Info(f func() interface{}) CheckFunc {
+	return func(context.Context) Status {
+		return Status{OK: true, Details: f()}
+	}
+}
@@ -0,0 +1,112 @@
+package health_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/health"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TH struct {
+	*testing.T
+	h        *health.Health
+	recorder *httptest.ResponseRecorder
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TH {
+		return TH{
+			T:        t,
+			h:        health.New(time.Second),
+			recorder: httptest.NewRecorder(),
+		}
+	})
+
+	o.Spec("is ready when every check succeeds", func(t TH) {
+		t.h.Add("some-check", health.Info(func() interface{} { return 99 }))
+		t.h.Readiness().ServeHTTP(t.recorder, httptest.NewRequest("GET", "/ready", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{
+			"status": "ok",
+			"checks": {"some-check": {"ok": true, "details": 99}}
+		}`))
+	})
+
+	o.Spec("is not ready when a check fails", func(t TH) {
+		t.h.Add("some-check", health.Info(func() interface{} { return nil }))
+		t.h.Add("other-check", func(context.Context) health.Status {
+			return health.Status{Error: "some-error"}
+		})
+		t.h.Readiness().ServeHTTP(t.recorder, httptest.NewRequest("GET", "/ready", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{
+			"status": "unavailable",
+			"checks": {
+				"some-check": {"ok": true},
+				"other-check": {"ok": false, "error": "some-error"}
+			}
+		}`))
+	})
+
+	o.Spec("is alive without running the checks", func(t TH) {
+		var called bool
+		t.h.Add("some-check", func(context.Context) health.Status {
+			called = true
+			return health.Status{Error: "some-error"}
+		})
+		t.h.Liveness().ServeHTTP(t.recorder, httptest.NewRequest("GET", "/health", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"status": "ok"}`))
+		Expect(t, called).To(BeFalse())
+	})
+
+	o.Spec("gives up on slow checks", func(t TH) {
+		h := health.New(10 * time.Millisecond)
+		h.Add("some-check", func(ctx context.Context) health.Status {
+			<-ctx.Done()
+			return health.Status{Error: ctx.Err().Error()}
+		})
+		h.Readiness().ServeHTTP(t.recorder, httptest.NewRequest("GET", "/ready", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	o.Spec("checks HTTP dependencies", func(t TH) {
+		ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer ok.Close()
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer failing.Close()
+
+		Expect(t, health.HTTPCheck(http.DefaultClient, ok.URL)(context.Background()).OK).To(BeTrue())
+		Expect(t, health.HTTPCheck(http.DefaultClient, failing.URL)(context.Background()).OK).To(BeFalse())
+		Expect(t, health.HTTPCheck(http.DefaultClient, "http://invalid.invalid")(context.Background()).OK).To(BeFalse())
+	})
+
+	o.Spec("checks that a connection can be made", func(t TH) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(t, err).To(BeNil())
+		addr := lis.Addr().String()
+
+		Expect(t, health.DialCheck("tcp", addr)(context.Background()).OK).To(BeTrue())
+		lis.Close()
+		Expect(t, health.DialCheck("tcp", addr)(context.Background()).OK).To(BeFalse())
+	})
+}
@@ -0,0 +1,153 @@
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// XFCCHeader is the header Go-Router forwards the client certificate in.
+const XFCCHeader = "X-Forwarded-Client-Cert"
+
+// CertAuthenticator authenticates requests with a Diego instance identity
+// certificate. The certificate's organizational units identify the app
+// (app:<GUID>), space (space:<GUID>) and organization
+// (organization:<GUID>).
+type CertAuthenticator struct {
+	appIDs    map[string]bool
+	spaceIDs  map[string]bool
+	trustXFCC bool
+}
+
+// NewCertAuthenticator returns a new CertAuthenticator. A certificate is
+// accepted if its app or space is on the allow lists. The
+// X-Forwarded-Client-Cert header is only read if trustXFCC is true (the
+// header must be set by a trusted router such as Go-Router).
+func NewCertAuthenticator(appIDs, spaceIDs []string, trustXFCC bool) *CertAuthenticator {
+	return &CertAuthenticator{
+		appIDs:    toSet(appIDs),
+		spaceIDs:  toSet(spaceIDs),
+		trustXFCC: trustXFCC,
+	}
+}
+
+// Authenticate returns the identity of the request's client certificate.
+// The certificate is read from the TLS connection (it must have been
+// verified by the server) or the X-Forwarded-Client-Cert header.
+func (a *CertAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	cert, err := a.clientCert(r)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	i := FromCertificate(cert)
+	if !a.appIDs[i.AppID] && !a.spaceIDs[i.SpaceID] {
+		return Identity{}, fmt.Errorf("app %s in space %s is not allowed", i.AppID, i.SpaceID)
+	}
+
+	return i, nil
+}
+
+func (a *CertAuthenticator) clientCert(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0], nil
+	}
+
+	if !a.trustXFCC {
+		return nil, errors.New("no client certificate")
+	}
+
+	xfcc := r.Header.Get(XFCCHeader)
+	if xfcc == "" {
+		return nil, errors.New("no client certificate")
+	}
+
+	return parseXFCC(xfcc)
+}
+
+// FromCertificate reads the identity from a Diego instance identity
+// certificate.
+func FromCertificate(cert *x509.Certificate) Identity {
+	var i Identity
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		kv := strings.SplitN(ou, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "app":
+			i.AppID = kv[1]
+		case "space":
+			i.SpaceID = kv[1]
+		case "organization":
+			i.OrgID = kv[1]
+		}
+	}
+
+	return i
+}
+
+// parseXFCC parses either Go-Router's format (base64 encoded DER) or
+// Envoy's format (Cert="<URL encoded PEM>").
+func parseXFCC(xfcc string) (*x509.Certificate, error) {
+	var der []byte
+	if idx := strings.Index(xfcc, `Cert="`); idx >= 0 {
+		value := xfcc[idx+len(`Cert="`):]
+		if end := strings.Index(value, `"`); end >= 0 {
+			value = value[:end]
+		}
+
+		p, err := url.QueryUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode client certificate: %s", err)
+		}
+
+		block, _ := pem.Decode([]byte(p))
+		if block == nil {
+			return nil, errors.New("failed to decode client certificate PEM")
+		}
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(xfcc))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode client certificate: %s", err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate: %s", err)
+	}
+
+	return cert, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a context with the (already authenticated) identity.
+func NewContext(ctx context.Context, i Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, i)
+}
+
+// FromContext returns the identity stored in the context.
+func FromContext(ctx context.Context) (Identity, bool) {
+	i, ok := ctx.Value(contextKey{}).(Identity)
+	return i, ok
+}
+
+func toSet(values []string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+
+	return m
+}
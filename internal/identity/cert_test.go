@@ -0,0 +1,161 @@
+package identity_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+	cert *x509.Certificate
+	a    *identity.CertAuthenticator
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	cert := newCert(t, "app:some-app", "space:some-space", "organization:some-org")
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T:    t,
+			cert: cert,
+			a:    identity.NewCertAuthenticator([]string{"some-app"}, []string{"other-space"}, true),
+		}
+	})
+
+	o.Spec("reads the identity from a verified TLS client certificate", func(t TC) {
+		req := newCertRequest(t.T)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{t.cert}},
+		}
+
+		i, err := t.a.Authenticate(req)
+		Expect(t, err).To(BeNil())
+		Expect(t, i.AppID).To(Equal("some-app"))
+		Expect(t, i.SpaceID).To(Equal("some-space"))
+		Expect(t, i.OrgID).To(Equal("some-org"))
+	})
+
+	o.Spec("reads the identity from Go-Router's XFCC header", func(t TC) {
+		req := newCertRequest(t.T)
+		req.Header.Set("X-Forwarded-Client-Cert", base64.StdEncoding.EncodeToString(t.cert.Raw))
+
+		i, err := t.a.Authenticate(req)
+		Expect(t, err).To(BeNil())
+		Expect(t, i.AppID).To(Equal("some-app"))
+	})
+
+	o.Spec("reads the identity from Envoy's XFCC header", func(t TC) {
+		p := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: t.cert.Raw})
+		req := newCertRequest(t.T)
+		req.Header.Set("X-Forwarded-Client-Cert", `Hash=abc;Cert="`+url.QueryEscape(string(p))+`";Subject="x"`)
+
+		i, err := t.a.Authenticate(req)
+		Expect(t, err).To(BeNil())
+		Expect(t, i.SpaceID).To(Equal("some-space"))
+	})
+
+	o.Spec("allows certificates by space", func(t TC) {
+		a := identity.NewCertAuthenticator(nil, []string{"other-space"}, true)
+		req := newCertRequest(t.T)
+		req.Header.Set("X-Forwarded-Client-Cert", base64.StdEncoding.EncodeToString(newCert(t.T, "app:other-app", "space:other-space").Raw))
+
+		_, err := a.Authenticate(req)
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("rejects certificates that are not allowed", func(t TC) {
+		a := identity.NewCertAuthenticator([]string{"other-app"}, nil, true)
+		req := newCertRequest(t.T)
+		req.Header.Set("X-Forwarded-Client-Cert", base64.StdEncoding.EncodeToString(t.cert.Raw))
+
+		_, err := a.Authenticate(req)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("ignores the XFCC header unless it is trusted", func(t TC) {
+		a := identity.NewCertAuthenticator([]string{"some-app"}, nil, false)
+		req := newCertRequest(t.T)
+		req.Header.Set("X-Forwarded-Client-Cert", base64.StdEncoding.EncodeToString(t.cert.Raw))
+
+		_, err := a.Authenticate(req)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("rejects requests without a certificate", func(t TC) {
+		_, err := t.a.Authenticate(newCertRequest(t.T))
+		Expect(t, err).To(Not(BeNil()))
+
+		req := newCertRequest(t.T)
+		req.Header.Set("X-Forwarded-Client-Cert", "invalid")
+		_, err = t.a.Authenticate(req)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("stores the identity in a context", func(t TC) {
+		_, ok := identity.FromContext(context.Background())
+		Expect(t, ok).To(BeFalse())
+
+		ctx := identity.NewContext(context.Background(), identity.Identity{AppID: "some-app"})
+		i, ok := identity.FromContext(ctx)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, i.AppID).To(Equal("some-app"))
+	})
+}
+
+func newCertRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest("GET", "http://some.url", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return req
+}
+
+func newCert(t *testing.T, ous ...string) *x509.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:         "some-instance",
+			OrganizationalUnit: ous,
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
@@ -0,0 +1,147 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Headers are the names of the headers each part of the identity is
+// forwarded as. An empty name disables that header.
+type Headers struct {
+	UserID     string `json:"user_id"`
+	UserName   string `json:"user_name"`
+	ClientID   string `json:"client_id"`
+	Scopes     string `json:"scopes"`
+	SpaceRoles string `json:"space_roles"`
+
+	SourceAppID   string `json:"source_app_id"`
+	SourceSpaceID string `json:"source_space_id"`
+}
+
+// DefaultHeaders forwards each part of the identity.
+var DefaultHeaders = Headers{
+	UserID:     "X-CF-User-ID",
+	UserName:   "X-CF-User-Name",
+	ClientID:   "X-CF-Client-ID",
+	Scopes:     "X-CF-Scopes",
+	SpaceRoles: "X-CF-Space-Roles",
+
+	SourceAppID:   "X-CF-Source-App-ID",
+	SourceSpaceID: "X-CF-Source-Space-ID",
+}
+
+// UnmarshalEnv reads the headers as a JSON object (e.g.,
+// {"user_id":"X-User"}). Omitted headers are disabled.
+func (h *Headers) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+
+	var hh Headers
+	if err := json.Unmarshal([]byte(data), &hh); err != nil {
+		return fmt.Errorf("failed to parse identity headers: %s", err)
+	}
+	*h = hh
+
+	return nil
+}
+
+func (h Headers) names() []string {
+	var names []string
+	for _, n := range []string{h.UserID, h.UserName, h.ClientID, h.Scopes, h.SpaceRoles, h.SourceAppID, h.SourceSpaceID} {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+
+	return names
+}
+
+// Strip removes the headers from the request so that a client can not
+// impersonate another identity.
+func (h Headers) Strip(r *http.Request) {
+	for _, n := range h.names() {
+		r.Header.Del(n)
+	}
+}
+
+// StripHandler strips the headers from each request before passing it to
+// the given handler.
+func StripHandler(h Headers, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Strip(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RoleFetcher looks up the space roles of a user.
+type RoleFetcher interface {
+	SpaceRoles(token, userID string) ([]string, error)
+}
+
+// Forwarder sets the identity headers from a request's (already validated)
+// token.
+type Forwarder struct {
+	h   Headers
+	f   RoleFetcher
+	log logger.Logger
+}
+
+func NewForwarder(h Headers, f RoleFetcher, log logger.Logger) *Forwarder {
+	return &Forwarder{
+		h:   h,
+		f:   f,
+		log: log,
+	}
+}
+
+// Forward strips any client supplied identity headers and sets them from the
+// request's token and the client certificate identity stored in the
+// request's context (see NewContext). Space roles are only looked up if the
+// header is enabled and the token belongs to a user.
+func (f *Forwarder) Forward(r *http.Request) {
+	f.h.Strip(r)
+
+	set := func(name, value string) {
+		if name == "" || value == "" {
+			return
+		}
+		r.Header.Set(name, value)
+	}
+
+	if c, ok := FromContext(r.Context()); ok {
+		set(f.h.SourceAppID, c.AppID)
+		set(f.h.SourceSpaceID, c.SpaceID)
+	}
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return
+	}
+
+	i, err := FromToken(token)
+	if err != nil {
+		f.log.Errorf("failed to read identity from token: %s", err)
+		return
+	}
+
+	set(f.h.UserID, i.UserID)
+	set(f.h.UserName, i.UserName)
+	set(f.h.ClientID, i.ClientID)
+	set(f.h.Scopes, strings.Join(i.Scopes, " "))
+
+	if f.h.SpaceRoles == "" || i.UserID == "" {
+		return
+	}
+
+	roles, err := f.f.SpaceRoles(token, i.UserID)
+	if err != nil {
+		f.log.Errorf("failed to fetch space roles: %s", err)
+		return
+	}
+	set(f.h.SpaceRoles, strings.Join(roles, ","))
+}
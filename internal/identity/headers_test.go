@@ -0,0 +1,147 @@
+package identity_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TF struct {
+	*testing.T
+	spyRoleFetcher *spyRoleFetcher
+	f              *identity.Forwarder
+}
+
+func TestForwarder(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TF {
+		spyRoleFetcher := newSpyRoleFetcher()
+		return TF{
+			T:              t,
+			spyRoleFetcher: spyRoleFetcher,
+			f:              identity.NewForwarder(identity.DefaultHeaders, spyRoleFetcher, logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
+		}
+	})
+
+	o.Spec("sets the identity headers from the token", func(t TF) {
+		t.spyRoleFetcher.roles = []string{"developer", "auditor"}
+		req := newRequest(t.T, jwt.MapClaims{
+			"user_id":   "some-user-id",
+			"user_name": "some-user",
+			"client_id": "some-client",
+			"scope":     []string{"a", "b"},
+		})
+		t.f.Forward(req)
+
+		Expect(t, req.Header.Get("X-CF-User-ID")).To(Equal("some-user-id"))
+		Expect(t, req.Header.Get("X-CF-User-Name")).To(Equal("some-user"))
+		Expect(t, req.Header.Get("X-CF-Client-ID")).To(Equal("some-client"))
+		Expect(t, req.Header.Get("X-CF-Scopes")).To(Equal("a b"))
+		Expect(t, req.Header.Get("X-CF-Space-Roles")).To(Equal("developer,auditor"))
+		Expect(t, t.spyRoleFetcher.userID).To(Equal("some-user-id"))
+	})
+
+	o.Spec("strips client supplied headers", func(t TF) {
+		req := newRequest(t.T, jwt.MapClaims{"client_id": "some-client"})
+		req.Header.Set("X-CF-User-ID", "spoofed")
+		req.Header.Set("X-CF-Space-Roles", "manager")
+		t.f.Forward(req)
+
+		Expect(t, req.Header).To(Not(HaveKey("X-Cf-User-Id")))
+		Expect(t, req.Header).To(Not(HaveKey("X-Cf-Space-Roles")))
+		Expect(t, req.Header.Get("X-CF-Client-ID")).To(Equal("some-client"))
+		Expect(t, t.spyRoleFetcher.userID).To(Equal(""))
+	})
+
+	o.Spec("does not set the space roles if they can not be fetched", func(t TF) {
+		t.spyRoleFetcher.roles = []string{"developer"}
+		t.spyRoleFetcher.err = errors.New("some-error")
+		req := newRequest(t.T, jwt.MapClaims{"user_id": "some-user-id"})
+		req.Header.Set("X-CF-Space-Roles", "manager")
+		t.f.Forward(req)
+
+		Expect(t, req.Header.Get("X-CF-User-ID")).To(Equal("some-user-id"))
+		Expect(t, req.Header).To(Not(HaveKey("X-Cf-Space-Roles")))
+	})
+
+	o.Spec("sets the source app headers from the context", func(t TF) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-User-ID", "spoofed")
+		req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{
+			AppID:   "some-app",
+			SpaceID: "some-space",
+		}))
+		t.f.Forward(req)
+
+		Expect(t, req.Header.Get("X-CF-Source-App-ID")).To(Equal("some-app"))
+		Expect(t, req.Header.Get("X-CF-Source-Space-ID")).To(Equal("some-space"))
+		Expect(t, req.Header).To(Not(HaveKey("X-Cf-User-Id")))
+	})
+
+	o.Spec("uses the configured header names", func(t TF) {
+		var h identity.Headers
+		Expect(t, h.UnmarshalEnv(`{"user_id": "X-User"}`)).To(BeNil())
+
+		f := identity.NewForwarder(h, t.spyRoleFetcher, logger.New(ioutil.Discard, "", logger.Debug, logger.Text))
+		req := newRequest(t.T, jwt.MapClaims{"user_id": "some-user-id", "client_id": "some-client"})
+		f.Forward(req)
+
+		Expect(t, req.Header.Get("X-User")).To(Equal("some-user-id"))
+		Expect(t, req.Header).To(Not(HaveKey("X-Cf-Client-Id")))
+		Expect(t, t.spyRoleFetcher.userID).To(Equal(""))
+	})
+
+	o.Spec("strips the headers for other handlers", func(t TF) {
+		var r *http.Request
+		h := identity.StripHandler(identity.DefaultHeaders, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r = req
+		}))
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-User-ID", "spoofed")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(t, r.Header).To(Not(HaveKey("X-Cf-User-Id")))
+	})
+}
+
+func newRequest(t *testing.T, c jwt.MapClaims) *http.Request {
+	req, err := http.NewRequest("GET", "http://some.url", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "bearer "+newToken(t, c))
+
+	return req
+}
+
+type spyRoleFetcher struct {
+	token  string
+	userID string
+	roles  []string
+	err    error
+}
+
+func newSpyRoleFetcher() *spyRoleFetcher {
+	return &spyRoleFetcher{}
+}
+
+func (s *spyRoleFetcher) SpaceRoles(token, userID string) ([]string, error) {
+	s.token = token
+	s.userID = userID
+	return s.roles, s.err
+}
@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Identity is who a token or client certificate was issued to.
+type Identity struct {
+	UserID   string
+	UserName string
+	ClientID string
+	Scopes   []string
+
+	// ExpiresAt is zero if the token has no expiration.
+	ExpiresAt time.Time
+
+	// Set from a client certificate
+	AppID   string
+	SpaceID string
+	OrgID   string
+}
+
+// HasScope reports whether the identity was granted the given scope.
+func (i Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FromToken reads the identity from the claims of a UAA issued JWT (with or
+// without the bearer prefix). The signature is NOT verified, therefore this
+// should only be used on tokens that have already been validated.
+func FromToken(token string) (Identity, error) {
+	token = trimBearer(token)
+	if token == "" {
+		return Identity{}, errors.New("empty token")
+	}
+
+	c := jwt.MapClaims{}
+	if _, _, err := (&jwt.Parser{}).ParseUnverified(token, c); err != nil {
+		return Identity{}, fmt.Errorf("failed to parse JWT: %s", err)
+	}
+
+	i := Identity{
+		UserID:   stringClaim(c, "user_id"),
+		UserName: stringClaim(c, "user_name"),
+		ClientID: stringClaim(c, "client_id"),
+	}
+
+	if exp, ok := c["exp"].(float64); ok {
+		i.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+
+	scopes, _ := c["scope"].([]interface{})
+	for _, s := range scopes {
+		if ss, ok := s.(string); ok {
+			i.Scopes = append(i.Scopes, ss)
+		}
+	}
+
+	return i, nil
+}
+
+func trimBearer(token string) string {
+	token = strings.TrimSpace(token)
+	if len(token) > len("bearer ") && strings.EqualFold(token[:len("bearer ")], "bearer ") {
+		return token[len("bearer "):]
+	}
+
+	return token
+}
+
+func stringClaim(c jwt.MapClaims, name string) string {
+	s, _ := c[name].(string)
+	return s
+}
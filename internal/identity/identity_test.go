@@ -0,0 +1,63 @@
+package identity_test
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestIdentity(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("reads the identity from the token", func(t *testing.T) {
+		token := newToken(t, jwt.MapClaims{
+			"user_id":   "some-user-id",
+			"user_name": "some-user",
+			"client_id": "some-client",
+			"scope":     []string{"cloud_controller.read", "openid"},
+			"exp":       1234,
+		})
+
+		i, err := identity.FromToken("bearer " + token)
+		Expect(t, err).To(BeNil())
+		Expect(t, i.UserID).To(Equal("some-user-id"))
+		Expect(t, i.UserName).To(Equal("some-user"))
+		Expect(t, i.ClientID).To(Equal("some-client"))
+		Expect(t, i.Scopes).To(Equal([]string{"cloud_controller.read", "openid"}))
+		Expect(t, i.HasScope("openid")).To(BeTrue())
+		Expect(t, i.HasScope("cloud_controller.write")).To(BeFalse())
+		Expect(t, i.ExpiresAt.Equal(time.Unix(1234, 0))).To(BeTrue())
+	})
+
+	o.Spec("accepts a token without the bearer prefix", func(t *testing.T) {
+		token := newToken(t, jwt.MapClaims{"client_id": "some-client"})
+
+		i, err := identity.FromToken(token)
+		Expect(t, err).To(BeNil())
+		Expect(t, i.ClientID).To(Equal("some-client"))
+	})
+
+	o.Spec("returns an error for an invalid token", func(t *testing.T) {
+		_, err := identity.FromToken("bearer invalid")
+		Expect(t, err).To(Not(BeNil()))
+
+		_, err = identity.FromToken("")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func newToken(t *testing.T, c jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte("some-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
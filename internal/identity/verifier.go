@@ -0,0 +1,150 @@
+package identity
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Doer is used to make HTTP requests.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Verifier verifies the signature and expiration of UAA issued tokens with
+// UAA's token keys. It does NOT check if the token has been revoked or has
+// access to anything.
+type Verifier struct {
+	uaaAddr string
+	d       Doer
+	log     logger.Logger
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	refreshedAt time.Time
+}
+
+// minRefreshInterval keeps tokens with unknown key IDs from causing a
+// request to UAA each.
+const minRefreshInterval = 30 * time.Second
+
+func NewVerifier(uaaAddr string, d Doer, log logger.Logger) *Verifier {
+	return &Verifier{
+		uaaAddr: uaaAddr,
+		d:       d,
+		log:     log,
+		keys:    make(map[string]*rsa.PublicKey),
+	}
+}
+
+// Verify returns an error if the token (with or without the bearer prefix)
+// is not signed by one of UAA's keys or has expired. The keys are fetched
+// from UAA when a token has a key ID that is not yet known.
+func (v *Verifier) Verify(token string) error {
+	_, err := jwt.Parse(trimBearer(token), func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %s", t.Method.Alg())
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := v.key(kid); ok {
+			return key, nil
+		}
+
+		if !v.canRefresh() {
+			return nil, fmt.Errorf("unknown key ID: %s", kid)
+		}
+
+		if err := v.Refresh(); err != nil {
+			return nil, err
+		}
+
+		if key, ok := v.key(kid); ok {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	})
+
+	return err
+}
+
+func (v *Verifier) key(kid string) (*rsa.PublicKey, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func (v *Verifier) canRefresh() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return time.Since(v.refreshedAt) >= minRefreshInterval
+}
+
+// Refresh fetches UAA's token keys.
+func (v *Verifier) Refresh() error {
+	v.mu.Lock()
+	v.refreshedAt = time.Now()
+	v.mu.Unlock()
+
+	req, err := http.NewRequest("GET", v.uaaAddr+"/token_keys", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.d.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch token keys from UAA (%s): %s", v.uaaAddr, err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from UAA: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Keys []struct {
+			KeyID string `json:"kid"`
+			Value string `json:"value"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode token keys: %s", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range result.Keys {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(k.Value))
+		if err != nil {
+			v.log.Errorf("failed to parse token key %s: %s", k.KeyID, err)
+			continue
+		}
+		keys[k.KeyID] = key
+	}
+
+	if len(keys) == 0 {
+		return errors.New("UAA did not return any usable token keys")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	v.log.With(logger.Fields{"keys": len(keys)}).Debugf("fetched UAA token keys")
+
+	return nil
+}
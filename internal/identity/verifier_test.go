@@ -0,0 +1,140 @@
+package identity_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TVF struct {
+	*testing.T
+	key      *rsa.PrivateKey
+	spyDoer  *spyDoer
+	verifier *identity.Verifier
+}
+
+func TestVerifier(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o.BeforeEach(func(t *testing.T) TVF {
+		spyDoer := newSpyDoer(t, "some-key-id", &key.PublicKey)
+		return TVF{
+			T:        t,
+			key:      key,
+			spyDoer:  spyDoer,
+			verifier: identity.NewVerifier("http://uaa.some.url", spyDoer, logger.New(ioutil.Discard, "", logger.Debug, logger.Text)),
+		}
+	})
+
+	o.Spec("verifies tokens signed by UAA", func(t TVF) {
+		token := signToken(t.T, t.key, "some-key-id", time.Now().Add(time.Hour))
+
+		Expect(t, t.verifier.Verify("bearer "+token)).To(BeNil())
+		Expect(t, t.verifier.Verify(token)).To(BeNil())
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+		Expect(t, t.spyDoer.reqs[0].URL.String()).To(Equal("http://uaa.some.url/token_keys"))
+	})
+
+	o.Spec("rejects expired tokens", func(t TVF) {
+		token := signToken(t.T, t.key, "some-key-id", time.Now().Add(-time.Hour))
+		Expect(t, t.verifier.Verify(token)).To(Not(BeNil()))
+	})
+
+	o.Spec("rejects tokens signed by other keys", func(t TVF) {
+		other, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(t, err).To(BeNil())
+
+		token := signToken(t.T, other, "some-key-id", time.Now().Add(time.Hour))
+		Expect(t, t.verifier.Verify(token)).To(Not(BeNil()))
+	})
+
+	o.Spec("rejects tokens that are not signed with RSA", func(t TVF) {
+		Expect(t, t.verifier.Verify(newToken(t.T, jwt.MapClaims{}))).To(Not(BeNil()))
+	})
+
+	o.Spec("does not fetch keys for each unknown key ID", func(t TVF) {
+		Expect(t, t.verifier.Verify(signToken(t.T, t.key, "unknown", time.Now().Add(time.Hour)))).To(Not(BeNil()))
+		Expect(t, t.verifier.Verify(signToken(t.T, t.key, "unknown", time.Now().Add(time.Hour)))).To(Not(BeNil()))
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("returns an error if UAA can not be reached", func(t TVF) {
+		t.spyDoer.err = errors.New("some-error")
+		Expect(t, t.verifier.Refresh()).To(Not(BeNil()))
+	})
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, exp time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"exp": exp.Unix(),
+	})
+	token.Header["kid"] = kid
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+type spyDoer struct {
+	body []byte
+	reqs []*http.Request
+	err  error
+}
+
+func newSpyDoer(t *testing.T, kid string, key *rsa.PublicKey) *spyDoer {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid":   kid,
+				"value": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &spyDoer{body: body}
+}
+
+func (s *spyDoer) Do(r *http.Request) (*http.Response, error) {
+	s.reqs = append(s.reqs, r)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader(s.body)),
+	}, nil
+}
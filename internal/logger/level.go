@@ -0,0 +1,81 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// UnmarshalEnv implements envstruct.Unmarshaller.
+func (l *Level) UnmarshalEnv(data string) error {
+	switch strings.ToLower(data) {
+	case "debug":
+		*l = Debug
+	case "info", "":
+		*l = Info
+	case "warn", "warning":
+		*l = Warn
+	case "error":
+		*l = Error
+	default:
+		return fmt.Errorf("unknown log level: %s", data)
+	}
+
+	return nil
+}
+
+// Format is how each message is written.
+type Format int
+
+const (
+	// Text writes each message similar to the standard library's log
+	// package.
+	Text Format = iota
+
+	// JSON writes each message as a JSON object.
+	JSON
+)
+
+func (f Format) String() string {
+	if f == JSON {
+		return "json"
+	}
+
+	return "text"
+}
+
+// UnmarshalEnv implements envstruct.Unmarshaller.
+func (f *Format) UnmarshalEnv(data string) error {
+	switch strings.ToLower(data) {
+	case "text", "":
+		*f = Text
+	case "json":
+		*f = JSON
+	default:
+		return fmt.Errorf("unknown log format: %s", data)
+	}
+
+	return nil
+}
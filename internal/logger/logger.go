@@ -0,0 +1,165 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger writes leveled messages with structured fields.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+
+	// Fatalf writes the message at the error level and exits the process.
+	Fatalf(format string, v ...interface{})
+
+	// Panicf writes the message at the error level and then panics.
+	Panicf(format string, v ...interface{})
+
+	// With returns a Logger that includes the given fields with each
+	// message.
+	With(fields Fields) Logger
+}
+
+// Fields are key value pairs that are written with each message.
+type Fields map[string]interface{}
+
+type logger struct {
+	mu        *sync.Mutex
+	w         io.Writer
+	component string
+	level     Level
+	format    Format
+	fields    Fields
+}
+
+// New returns a new Logger. Messages below the given level are dropped.
+func New(w io.Writer, component string, level Level, format Format) Logger {
+	return &logger{
+		mu:        &sync.Mutex{},
+		w:         w,
+		component: component,
+		level:     level,
+		format:    format,
+	}
+}
+
+func (l *logger) Debugf(format string, v ...interface{}) {
+	l.write(Debug, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Infof(format string, v ...interface{}) {
+	l.write(Info, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Warnf(format string, v ...interface{}) {
+	l.write(Warn, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Errorf(format string, v ...interface{}) {
+	l.write(Error, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Fatalf(format string, v ...interface{}) {
+	l.write(Error, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (l *logger) Panicf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.write(Error, msg)
+	panic(msg)
+}
+
+func (l *logger) With(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	child := *l
+	child.fields = merged
+	return &child
+}
+
+func (l *logger) write(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+
+	now := time.Now()
+
+	var line string
+	switch l.format {
+	case JSON:
+		m := make(map[string]interface{}, len(l.fields)+4)
+		for k, v := range l.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			m[k] = v
+		}
+		m["timestamp"] = now.UTC().Format(time.RFC3339Nano)
+		m["level"] = level.String()
+		m["component"] = l.component
+		m["message"] = msg
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			data, _ = json.Marshal(map[string]string{
+				"level":   Error.String(),
+				"message": fmt.Sprintf("failed to marshal log message (%q): %s", msg, err),
+			})
+		}
+		line = string(data)
+	default:
+		parts := []string{
+			fmt.Sprintf("[%s]", l.component),
+			now.Format("2006/01/02 15:04:05"),
+			strings.ToUpper(level.String()),
+			msg,
+		}
+
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%v", k, l.fields[k]))
+		}
+		line = strings.Join(parts, " ")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line+"\n")
+}
+
+// NewStdLogger returns a *log.Logger that writes each message to the given
+// Logger at the error level. It is useful for things like
+// httputil.ReverseProxy.ErrorLog.
+func NewStdLogger(l Logger) *log.Logger {
+	return log.New(stdWriter{l: l}, "", 0)
+}
+
+type stdWriter struct {
+	l Logger
+}
+
+func (w stdWriter) Write(data []byte) (int, error) {
+	w.l.Errorf("%s", strings.TrimRight(string(data), "\n"))
+	return len(data), nil
+}
@@ -0,0 +1,99 @@
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TL struct {
+	*testing.T
+	buf *bytes.Buffer
+}
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TL {
+		return TL{
+			T:   t,
+			buf: &bytes.Buffer{},
+		}
+	})
+
+	o.Spec("drops messages below the level", func(t TL) {
+		l := logger.New(t.buf, "SOME-COMPONENT", logger.Info, logger.Text)
+		l.Debugf("some-debug")
+		l.Infof("some-info %d", 99)
+		l.Errorf("some-error")
+
+		lines := strings.Split(strings.TrimSpace(t.buf.String()), "\n")
+		Expect(t, lines).To(HaveLen(2))
+		Expect(t, lines[0]).To(StartWith("[SOME-COMPONENT] "))
+		Expect(t, lines[0]).To(EndWith(" INFO some-info 99"))
+		Expect(t, lines[1]).To(EndWith(" ERROR some-error"))
+	})
+
+	o.Spec("writes fields in text", func(t TL) {
+		l := logger.New(t.buf, "SOME-COMPONENT", logger.Debug, logger.Text)
+		l.With(logger.Fields{"b": 2, "a": "x"}).Debugf("some-debug")
+
+		Expect(t, strings.TrimSpace(t.buf.String())).To(EndWith(" DEBUG some-debug a=x b=2"))
+	})
+
+	o.Spec("writes JSON", func(t TL) {
+		l := logger.New(t.buf, "SOME-COMPONENT", logger.Debug, logger.JSON)
+		l.With(logger.Fields{"a": "x"}).With(logger.Fields{"err": errors.New("some-error")}).Warnf("some-warning")
+
+		var m map[string]interface{}
+		Expect(t, json.Unmarshal(t.buf.Bytes(), &m)).To(BeNil())
+		Expect(t, m["level"]).To(Equal("warn"))
+		Expect(t, m["component"]).To(Equal("SOME-COMPONENT"))
+		Expect(t, m["message"]).To(Equal("some-warning"))
+		Expect(t, m["a"]).To(Equal("x"))
+		Expect(t, m["err"]).To(Equal("some-error"))
+		Expect(t, m["timestamp"]).To(Not(Equal("")))
+	})
+
+	o.Spec("does not leak fields into the parent", func(t TL) {
+		l := logger.New(t.buf, "SOME-COMPONENT", logger.Debug, logger.Text)
+		l.With(logger.Fields{"a": "x"})
+		l.Infof("some-info")
+
+		Expect(t, strings.TrimSpace(t.buf.String())).To(EndWith(" INFO some-info"))
+	})
+
+	o.Spec("panics after writing", func(t TL) {
+		l := logger.New(t.buf, "SOME-COMPONENT", logger.Debug, logger.Text)
+		Expect(t, func() { l.Panicf("some-panic") }).To(Panic())
+		Expect(t, t.buf.String()).To(ContainSubstring("ERROR some-panic"))
+	})
+
+	o.Spec("adapts to a *log.Logger", func(t TL) {
+		l := logger.New(t.buf, "SOME-COMPONENT", logger.Debug, logger.Text)
+		logger.NewStdLogger(l).Printf("some-message")
+
+		Expect(t, strings.TrimSpace(t.buf.String())).To(EndWith(" ERROR some-message"))
+	})
+
+	o.Spec("parses levels and formats", func(t TL) {
+		var level logger.Level
+		Expect(t, level.UnmarshalEnv("DEBUG")).To(BeNil())
+		Expect(t, level).To(Equal(logger.Debug))
+		Expect(t, level.UnmarshalEnv("invalid")).To(Not(BeNil()))
+
+		var format logger.Format
+		Expect(t, format.UnmarshalEnv("json")).To(BeNil())
+		Expect(t, format).To(Equal(logger.JSON))
+		Expect(t, format.UnmarshalEnv("invalid")).To(Not(BeNil()))
+	})
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) used for latency
+// histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram is an expvar.Var that counts observations into cumulative
+// buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// HistogramSnapshot is a point in time copy of a Histogram. Counts are
+// cumulative and line up with Buckets.
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// Snapshot returns a copy of the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := HistogramSnapshot{
+		Buckets: make([]float64, len(h.buckets)),
+		Counts:  make([]uint64, len(h.counts)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+	copy(s.Buckets, h.buckets)
+	copy(s.Counts, h.counts)
+
+	return s
+}
+
+// String implements expvar.Var.
+func (h *Histogram) String() string {
+	s := h.Snapshot()
+
+	buckets := make(map[string]uint64, len(s.Buckets))
+	for i, upper := range s.Buckets {
+		buckets[strconv.FormatFloat(upper, 'g', -1, 64)] = s.Counts[i]
+	}
+
+	data, _ := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Sum     float64           `json:"sum"`
+		Count   uint64            `json:"count"`
+	}{
+		Buckets: buckets,
+		Sum:     s.Sum,
+		Count:   s.Count,
+	})
+
+	return string(data)
+}
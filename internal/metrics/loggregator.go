@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// LoggregatorExporter periodically sends the counters and gauges from an
+// expvar.Map to a Loggregator ingress endpoint as a batch of v2 envelopes
+// (JSON encoded). Labeled metrics are sent with their labels as tags.
+type LoggregatorExporter struct {
+	addr       string
+	sourceID   string
+	instanceID string
+	m          *expvar.Map
+	d          Doer
+	log        logger.Logger
+
+	totals map[string]int64
+}
+
+// Doer is used to make HTTP requests.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// NewLoggregatorExporter returns a new LoggregatorExporter. Each envelope
+// will have the given source and instance IDs.
+func NewLoggregatorExporter(addr, sourceID, instanceID string, m *expvar.Map, d Doer, log logger.Logger) *LoggregatorExporter {
+	return &LoggregatorExporter{
+		addr:       addr,
+		sourceID:   sourceID,
+		instanceID: instanceID,
+		m:          m,
+		d:          d,
+		log:        log,
+		totals:     make(map[string]int64),
+	}
+}
+
+// Run emits the metrics every interval until the context is done. The
+// metrics are then emitted one last time.
+func (e *LoggregatorExporter) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.Emit()
+		case <-ctx.Done():
+			e.Emit()
+			return
+		}
+	}
+}
+
+type envelopeBatch struct {
+	Batch []envelope `json:"batch"`
+}
+
+type envelope struct {
+	Timestamp  string            `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Counter    *counter          `json:"counter,omitempty"`
+	Gauge      *gauge            `json:"gauge,omitempty"`
+}
+
+type counter struct {
+	Name  string `json:"name"`
+	Delta string `json:"delta"`
+	Total string `json:"total"`
+}
+
+type gauge struct {
+	Metrics map[string]gaugeValue `json:"metrics"`
+}
+
+type gaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+// Emit sends the current value of each counter and gauge. Counter deltas
+// are carried over to the next emit if the metrics can not be sent. It is
+// not safe to call concurrently.
+func (e *LoggregatorExporter) Emit() {
+	batch, totals := e.envelopes(time.Now())
+	if len(batch) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(envelopeBatch{Batch: batch})
+	if err != nil {
+		e.log.Panicf("failed to marshal envelopes: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.addr, bytes.NewReader(data))
+	if err != nil {
+		e.log.Errorf("failed to create Loggregator request: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.d.Do(req)
+	if err != nil {
+		e.log.Errorf("failed to send metrics to Loggregator (%s): %s", e.addr, err)
+		return
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e.log.Errorf("failed to send metrics to Loggregator (%s): %d", e.addr, resp.StatusCode)
+		return
+	}
+
+	for k, v := range totals {
+		e.totals[k] = v
+	}
+}
+
+// envelopes returns the envelopes along with the counter totals they were
+// based on.
+func (e *LoggregatorExporter) envelopes(now time.Time) ([]envelope, map[string]int64) {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+
+	var batch []envelope
+	totals := make(map[string]int64)
+	add := func(name, labels string, tags map[string]string, v expvar.Var) {
+		env := envelope{
+			Timestamp:  ts,
+			SourceID:   e.sourceID,
+			InstanceID: e.instanceID,
+			Tags:       tags,
+		}
+
+		switch x := v.(type) {
+		case *expvar.Int:
+			key := name + "{" + labels + "}"
+			total := x.Value()
+			env.Counter = &counter{
+				Name:  name,
+				Delta: strconv.FormatInt(total-e.totals[key], 10),
+				Total: strconv.FormatInt(total, 10),
+			}
+			totals[key] = total
+		case *expvar.Float:
+			env.Gauge = &gauge{
+				Metrics: map[string]gaugeValue{
+					name: {Value: x.Value()},
+				},
+			}
+		default:
+			return
+		}
+
+		batch = append(batch, env)
+	}
+
+	e.m.Do(func(kv expvar.KeyValue) {
+		children, ok := kv.Value.(*expvar.Map)
+		if !ok {
+			add(kv.Key, "", nil, kv.Value)
+			return
+		}
+
+		children.Do(func(child expvar.KeyValue) {
+			names, values := parseLabelKey(child.Key)
+			tags := make(map[string]string, len(names))
+			for i, name := range names {
+				tags[name] = values[i]
+			}
+			add(kv.Key, child.Key, tags, child.Value)
+		})
+	})
+
+	return batch, totals
+}
@@ -0,0 +1,183 @@
+package metrics_test
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TL struct {
+	*testing.T
+	m       metrics.Metrics
+	e       *metrics.LoggregatorExporter
+	ingress *fakeIngress
+}
+
+func TestLoggregatorExporter(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TL {
+		expvarMap := new(expvar.Map).Init()
+		ingress := newFakeIngress()
+		server := httptest.NewServer(ingress)
+
+		return TL{
+			T:       t,
+			m:       metrics.New(expvarMap),
+			ingress: ingress,
+			e: metrics.NewLoggregatorExporter(
+				server.URL+"/v2/envelopes",
+				"some-source-id",
+				"some-instance-id",
+				expvarMap,
+				http.DefaultClient,
+				logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+			),
+		}
+	})
+
+	o.Spec("sends counters with their deltas", func(t TL) {
+		c := t.m.NewCounter("SomeCounter")
+		c(99)
+		t.e.Emit()
+		c(1)
+		t.e.Emit()
+
+		batches := t.ingress.getBatches()
+		Expect(t, batches).To(HaveLen(2))
+		Expect(t, batches[0]).To(HaveLen(1))
+		Expect(t, batches[0][0]["source_id"]).To(Equal("some-source-id"))
+		Expect(t, batches[0][0]["instance_id"]).To(Equal("some-instance-id"))
+		Expect(t, batches[0][0]["counter"]).To(Equal(map[string]interface{}{
+			"name":  "SomeCounter",
+			"delta": "99",
+			"total": "99",
+		}))
+		Expect(t, batches[1][0]["counter"]).To(Equal(map[string]interface{}{
+			"name":  "SomeCounter",
+			"delta": "1",
+			"total": "100",
+		}))
+	})
+
+	o.Spec("keeps the deltas of counters that failed to send", func(t TL) {
+		c := t.m.NewCounter("SomeCounter")
+		c(99)
+		t.ingress.setFail(true)
+		t.e.Emit()
+		c(1)
+		t.ingress.setFail(false)
+		t.e.Emit()
+
+		batches := t.ingress.getBatches()
+		Expect(t, batches).To(HaveLen(2))
+		Expect(t, batches[1][0]["counter"]).To(Equal(map[string]interface{}{
+			"name":  "SomeCounter",
+			"delta": "100",
+			"total": "100",
+		}))
+	})
+
+	o.Spec("sends gauges", func(t TL) {
+		t.m.NewGauge("SomeGauge")(1.5)
+		t.e.Emit()
+
+		batches := t.ingress.getBatches()
+		Expect(t, batches).To(HaveLen(1))
+		Expect(t, batches[0][0]["gauge"]).To(Equal(map[string]interface{}{
+			"metrics": map[string]interface{}{
+				"SomeGauge": map[string]interface{}{
+					"unit":  "",
+					"value": 1.5,
+				},
+			},
+		}))
+	})
+
+	o.Spec("sends labels as tags", func(t TL) {
+		t.m.NewLabeledCounter("SomeCounter", "host")(3, "some.url")
+		t.e.Emit()
+
+		batches := t.ingress.getBatches()
+		Expect(t, batches).To(HaveLen(1))
+		Expect(t, batches[0][0]["tags"]).To(Equal(map[string]interface{}{
+			"host": "some.url",
+		}))
+	})
+
+	o.Spec("does not send empty batches", func(t TL) {
+		t.m.NewHistogram("SomeHistogram", nil)(1)
+		t.e.Emit()
+
+		Expect(t, t.ingress.getBatches()).To(HaveLen(0))
+	})
+
+	o.Spec("emits one last time when the context is done", func(t TL) {
+		t.m.NewCounter("SomeCounter")(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.e.Run(ctx, time.Hour)
+
+		Expect(t, t.ingress.getBatches()).To(HaveLen(1))
+	})
+}
+
+type fakeIngress struct {
+	mu      sync.Mutex
+	fail    bool
+	batches [][]map[string]interface{}
+}
+
+func newFakeIngress() *fakeIngress {
+	return &fakeIngress{}
+}
+
+func (f *fakeIngress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v2/envelopes" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var batch struct {
+		Batch []map[string]interface{} `json:"batch"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, batch.Batch)
+
+	if f.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (f *fakeIngress) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeIngress) getBatches() [][]map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.batches
+}
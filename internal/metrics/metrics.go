@@ -1,12 +1,23 @@
 package metrics
 
-import "expvar"
+import (
+	"expvar"
+	"strings"
+	"sync"
+)
 
-// Metrics stores health metrics for the process. It has a gauge and counter
-// metrics.
+// Metrics stores health metrics for the process. It has a gauge, counter and
+// histogram metrics. Each has a labeled variant that is broken down by the
+// given label names. The label values are passed in the same order with each
+// update.
 type Metrics interface {
 	NewCounter(name string) func(delta uint64)
 	NewGauge(name string) func(value float64)
+	NewHistogram(name string, buckets []float64) func(value float64)
+
+	NewLabeledCounter(name string, labels ...string) func(delta uint64, labelValues ...string)
+	NewLabeledGauge(name string, labels ...string) func(value float64, labelValues ...string)
+	NewLabeledHistogram(name string, buckets []float64, labels ...string) func(value float64, labelValues ...string)
 }
 
 type metrics struct {
@@ -23,6 +34,9 @@ type Map interface {
 
 	// Get gets a Var from the Map.
 	Get(key string) expvar.Var
+
+	// Set sets a Var in the Map.
+	Set(key string, av expvar.Var)
 }
 
 // New returns a new Metrics.
@@ -57,3 +71,123 @@ func (m *metrics) NewGauge(name string) func(value float64) {
 
 	return f.Set
 }
+
+// NewHistogram returns a func to be used to record an observation.
+func (m *metrics) NewHistogram(name string, buckets []float64) func(value float64) {
+	if m.m == nil {
+		return func(_ float64) {}
+	}
+
+	h := newHistogram(buckets)
+	m.m.Set(name, h)
+
+	return h.Observe
+}
+
+// NewLabeledCounter returns a func to be used to increment the counter total
+// for the given label values.
+func (m *metrics) NewLabeledCounter(name string, labels ...string) func(delta uint64, labelValues ...string) {
+	if m.m == nil {
+		return func(_ uint64, _ ...string) {}
+	}
+
+	get := m.newLabeled(name, labels, func() expvar.Var { return new(expvar.Int) })
+
+	return func(d uint64, labelValues ...string) {
+		get(labelValues).(*expvar.Int).Add(int64(d))
+	}
+}
+
+// NewLabeledGauge returns a func to be used to set the value of a gauge for
+// the given label values.
+func (m *metrics) NewLabeledGauge(name string, labels ...string) func(value float64, labelValues ...string) {
+	if m.m == nil {
+		return func(_ float64, _ ...string) {}
+	}
+
+	get := m.newLabeled(name, labels, func() expvar.Var { return new(expvar.Float) })
+
+	return func(v float64, labelValues ...string) {
+		get(labelValues).(*expvar.Float).Set(v)
+	}
+}
+
+// NewLabeledHistogram returns a func to be used to record an observation for
+// the given label values.
+func (m *metrics) NewLabeledHistogram(name string, buckets []float64, labels ...string) func(value float64, labelValues ...string) {
+	if m.m == nil {
+		return func(_ float64, _ ...string) {}
+	}
+
+	get := m.newLabeled(name, labels, func() expvar.Var { return newHistogram(buckets) })
+
+	return func(v float64, labelValues ...string) {
+		get(labelValues).(*Histogram).Observe(v)
+	}
+}
+
+// newLabeled stores a nested map under the given name. Each set of label
+// values is stored as its own Var (created via newVar) in the nested map.
+func (m *metrics) newLabeled(name string, labels []string, newVar func() expvar.Var) func(labelValues []string) expvar.Var {
+	children := new(expvar.Map).Init()
+	m.m.Set(name, children)
+
+	var mu sync.Mutex
+	return func(labelValues []string) expvar.Var {
+		key := labelKey(labels, labelValues)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		v := children.Get(key)
+		if v == nil {
+			v = newVar()
+			children.Set(key, v)
+		}
+
+		return v
+	}
+}
+
+// OtherLabel is the label value that values from an unbounded set (e.g.,
+// hosts that are not configured) are counted under.
+const OtherLabel = "other"
+
+var (
+	labelEscaper   = strings.NewReplacer("%", "%25", ",", "%2C", "=", "%3D")
+	labelUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%3D", "=")
+)
+
+// labelKey encodes the label names and values into a key for a nested map
+// (e.g., host=some.url,status_class=2xx). Missing values are left empty.
+// The separators (and %) are percent-encoded in values.
+func labelKey(names, values []string) string {
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+"="+labelEscaper.Replace(value))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// parseLabelKey is the inverse of labelKey.
+func parseLabelKey(key string) (names, values []string) {
+	if key == "" {
+		return nil, nil
+	}
+
+	for _, pair := range strings.Split(key, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		names = append(names, kv[0])
+		values = append(values, labelUnescaper.Replace(kv[1]))
+	}
+
+	return names, values
+}
@@ -46,10 +46,64 @@ func TestMetrics(t *testing.T) {
 		Expect(t, t.spyMap.getValue("some-gauge")).To(Equal(101.1))
 	})
 
+	o.Spec("publishes the observations of a histogram", func(t TM) {
+		h := t.m.NewHistogram("some-histogram", []float64{1, 5})
+		h(0.5)
+		h(3)
+		h(10)
+
+		s := t.spyMap.m["some-histogram"].(*metrics.Histogram).Snapshot()
+		Expect(t, s.Buckets).To(Equal([]float64{1, 5}))
+		Expect(t, s.Counts).To(Equal([]uint64{1, 2}))
+		Expect(t, s.Count).To(Equal(uint64(3)))
+		Expect(t, s.Sum).To(Equal(13.5))
+	})
+
+	o.Spec("publishes a histogram for each set of label values", func(t TM) {
+		h := t.m.NewLabeledHistogram("some-histogram", []float64{1}, "a", "b")
+		h(0.5, "x", "y")
+		h(2, "x", "y")
+		h(0.5, "x", "z")
+
+		m := t.spyMap.m["some-histogram"].(*expvar.Map)
+		xy := m.Get("a=x,b=y").(*metrics.Histogram).Snapshot()
+		Expect(t, xy.Counts).To(Equal([]uint64{1}))
+		Expect(t, xy.Count).To(Equal(uint64(2)))
+
+		xz := m.Get("a=x,b=z").(*metrics.Histogram).Snapshot()
+		Expect(t, xz.Count).To(Equal(uint64(1)))
+	})
+
+	o.Spec("publishes a counter for each set of label values", func(t TM) {
+		c := t.m.NewLabeledCounter("some-counter", "a")
+		c(99, "x")
+		c(101, "x")
+		c(1, "y")
+
+		m := t.spyMap.m["some-counter"].(*expvar.Map)
+		Expect(t, m.Get("a=x").(*expvar.Int).Value()).To(Equal(int64(200)))
+		Expect(t, m.Get("a=y").(*expvar.Int).Value()).To(Equal(int64(1)))
+	})
+
+	o.Spec("publishes a gauge for each set of label values", func(t TM) {
+		g := t.m.NewLabeledGauge("some-gauge", "a", "b")
+		g(99.9, "x", "y")
+		g(101.1, "x", "y")
+		g(1, "x")
+
+		m := t.spyMap.m["some-gauge"].(*expvar.Map)
+		Expect(t, m.Get("a=x,b=y").(*expvar.Float).Value()).To(Equal(101.1))
+		Expect(t, m.Get("a=x,b=").(*expvar.Float).Value()).To(Equal(float64(1)))
+	})
+
 	o.Spec("deals with a nil map", func(t TM) {
 		t.m = metrics.New(nil)
 		Expect(t, func() { t.m.NewGauge("some-gauge") }).To(Not(Panic()))
 		Expect(t, func() { t.m.NewCounter("some-counter") }).To(Not(Panic()))
+		Expect(t, func() { t.m.NewHistogram("some-histogram", nil)(1) }).To(Not(Panic()))
+		Expect(t, func() { t.m.NewLabeledHistogram("some-histogram", nil, "a")(1, "b") }).To(Not(Panic()))
+		Expect(t, func() { t.m.NewLabeledCounter("some-counter", "a")(1, "b") }).To(Not(Panic()))
+		Expect(t, func() { t.m.NewLabeledGauge("some-gauge", "a")(1, "b") }).To(Not(Panic()))
 	})
 }
 
@@ -71,6 +125,10 @@ func (s *spyMap) AddFloat(key string, delta float64) {
 	s.m[key] = expvar.NewFloat(key)
 }
 
+func (s *spyMap) Set(key string, av expvar.Var) {
+	s.m[key] = av
+}
+
 func (s *spyMap) Get(key string) expvar.Var {
 	return s.m[key]
 }
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PrometheusHandler writes the metrics from an expvar.Map in the Prometheus
+// text exposition format.
+type PrometheusHandler struct {
+	namespace string
+	m         *expvar.Map
+}
+
+// NewPrometheusHandler returns a new PrometheusHandler. Each metric name is
+// converted to snake case and prefixed with the namespace (e.g.,
+// CacheMisses becomes <namespace>_cache_misses_total).
+func NewPrometheusHandler(namespace string, m *expvar.Map) *PrometheusHandler {
+	return &PrometheusHandler{
+		namespace: namespace,
+		m:         m,
+	}
+}
+
+func (h *PrometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	h.m.Do(func(kv expvar.KeyValue) {
+		h.writeMetric(&buf, h.metricName(kv.Key), kv.Value)
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.Copy(w, &buf)
+}
+
+func (h *PrometheusHandler) writeMetric(w io.Writer, name string, v expvar.Var) {
+	switch x := v.(type) {
+	case *expvar.Int:
+		fmt.Fprintf(w, "# TYPE %s_total counter\n", name)
+		fmt.Fprintf(w, "%s_total %d\n", name, x.Value())
+	case *expvar.Float:
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(x.Value()))
+	case *Histogram:
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		writeHistogram(w, name, nil, nil, x.Snapshot())
+	case *expvar.Map:
+		h.writeLabeled(w, name, x)
+	}
+}
+
+func (h *PrometheusHandler) writeLabeled(w io.Writer, name string, m *expvar.Map) {
+	var wroteType bool
+	m.Do(func(kv expvar.KeyValue) {
+		names, values := parseLabelKey(kv.Key)
+
+		switch x := kv.Value.(type) {
+		case *expvar.Int:
+			if !wroteType {
+				fmt.Fprintf(w, "# TYPE %s_total counter\n", name)
+			}
+			fmt.Fprintf(w, "%s_total%s %d\n", name, formatLabels(names, values), x.Value())
+		case *expvar.Float:
+			if !wroteType {
+				fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			}
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(names, values), formatFloat(x.Value()))
+		case *Histogram:
+			if !wroteType {
+				fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+			}
+			writeHistogram(w, name, names, values, x.Snapshot())
+		default:
+			return
+		}
+		wroteType = true
+	})
+}
+
+func writeHistogram(w io.Writer, name string, names, values []string, s HistogramSnapshot) {
+	bucketNames := append(append([]string{}, names...), "le")
+	for i, upper := range s.Buckets {
+		bucketValues := append(append([]string{}, values...), formatFloat(upper))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(bucketNames, bucketValues), s.Counts[i])
+	}
+	bucketValues := append(append([]string{}, values...), "+Inf")
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(bucketNames, bucketValues), s.Count)
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(names, values), formatFloat(s.Sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(names, values), s.Count)
+}
+
+func (h *PrometheusHandler) metricName(key string) string {
+	if h.namespace == "" {
+		return snakeCase(key)
+	}
+
+	return h.namespace + "_" + snakeCase(key)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper escapes label values as the text exposition format
+// expects. Unlike Go's quoting, everything else is written as is.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// snakeCase converts a CamelCase name (e.g., CAPIRequestLatency) into
+// snake case (e.g., capi_request_latency).
+func snakeCase(s string) string {
+	rs := []rune(s)
+
+	var buf bytes.Buffer
+	for i, r := range rs {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			buf.WriteRune('_')
+			continue
+		}
+
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			nextIsLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				buf.WriteRune('_')
+			}
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,113 @@
+package metrics_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TP struct {
+	*testing.T
+	expvarMap *expvar.Map
+	m         metrics.Metrics
+	h         http.Handler
+	recorder  *httptest.ResponseRecorder
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TP {
+		expvarMap := new(expvar.Map).Init()
+		return TP{
+			T:         t,
+			expvarMap: expvarMap,
+			m:         metrics.New(expvarMap),
+			h:         metrics.NewPrometheusHandler("some_namespace", expvarMap),
+			recorder:  httptest.NewRecorder(),
+		}
+	})
+
+	o.Spec("writes counters and gauges", func(t TP) {
+		t.m.NewCounter("CacheMisses")(99)
+		t.m.NewGauge("CAPIValue")(1.5)
+
+		req, err := http.NewRequest(http.MethodGet, "http://some.url/metrics", nil)
+		Expect(t, err).To(BeNil())
+		t.h.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("# TYPE some_namespace_cache_misses_total counter\nsome_namespace_cache_misses_total 99\n"))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("# TYPE some_namespace_capi_value gauge\nsome_namespace_capi_value 1.5\n"))
+	})
+
+	o.Spec("writes histograms", func(t TP) {
+		h := t.m.NewHistogram("SomeLatency", []float64{0.1, 1})
+		h(0.5)
+		h(2)
+
+		req, err := http.NewRequest(http.MethodGet, "http://some.url/metrics", nil)
+		Expect(t, err).To(BeNil())
+		t.h.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("# TYPE some_namespace_some_latency histogram\n"))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_some_latency_bucket{le="0.1"} 0`))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_some_latency_bucket{le="1"} 1`))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_some_latency_bucket{le="+Inf"} 2`))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("some_namespace_some_latency_sum 2.5\n"))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("some_namespace_some_latency_count 2\n"))
+	})
+
+	o.Spec("writes labeled counters and gauges", func(t TP) {
+		t.m.NewLabeledCounter("Requests", "host")(3, "some.url")
+		t.m.NewLabeledGauge("Value", "host")(1.5, "some.url")
+
+		req, err := http.NewRequest(http.MethodGet, "http://some.url/metrics", nil)
+		Expect(t, err).To(BeNil())
+		t.h.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("# TYPE some_namespace_requests_total counter\n"))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_requests_total{host="some.url"} 3`))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("# TYPE some_namespace_value gauge\n"))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_value{host="some.url"} 1.5`))
+	})
+
+	o.Spec("writes label values with separators", func(t TP) {
+		t.m.NewLabeledCounter("Requests", "host", "path")(3, "some,url", "a=b%2C")
+
+		req, err := http.NewRequest(http.MethodGet, "http://some.url/metrics", nil)
+		Expect(t, err).To(BeNil())
+		t.h.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_requests_total{host="some,url",path="a=b%2C"} 3`))
+	})
+
+	o.Spec("escapes label values", func(t TP) {
+		t.m.NewLabeledCounter("Requests", "path")(3, "/a\\b\"c\"\nd/é\t")
+
+		req, err := http.NewRequest(http.MethodGet, "http://some.url/metrics", nil)
+		Expect(t, err).To(BeNil())
+		t.h.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("some_namespace_requests_total{path=\"/a\\\\b\\\"c\\\"\\nd/é\t\"} 3"))
+	})
+
+	o.Spec("writes labeled histograms", func(t TP) {
+		h := t.m.NewLabeledHistogram("SomeLatency", []float64{1}, "host", "status_class")
+		h(0.5, "some.url", "2xx")
+
+		req, err := http.NewRequest(http.MethodGet, "http://some.url/metrics", nil)
+		Expect(t, err).To(BeNil())
+		t.h.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_some_latency_bucket{host="some.url",status_class="2xx",le="1"} 1`))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring(`some_namespace_some_latency_count{host="some.url",status_class="2xx"} 1`))
+	})
+}
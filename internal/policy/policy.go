@@ -0,0 +1,208 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Rule describes what is required of a token to make a request. A request
+// matches the rule if its path matches Path and its method is one of Methods
+// (any method if empty). Path is matched with MatchPath.
+//
+// A token satisfies the rule if it has all of the Scopes, its client ID is
+// one of the ClientIDs and its user has one of the SpaceRoles (developer,
+// manager or auditor). A client certificate satisfies the rule if it is from
+// one of the AppIDs and one of the SpaceIDs. Empty requirements are ignored.
+type Rule struct {
+	Path       string   `json:"path"`
+	Methods    []string `json:"methods"`
+	Scopes     []string `json:"scopes"`
+	ClientIDs  []string `json:"client_ids"`
+	SpaceRoles []string `json:"space_roles"`
+	AppIDs     []string `json:"app_ids"`
+	SpaceIDs   []string `json:"space_ids"`
+}
+
+func (r Rule) requiresToken() bool {
+	return len(r.Scopes) > 0 || len(r.ClientIDs) > 0 || len(r.SpaceRoles) > 0
+}
+
+func (r Rule) requiresCert() bool {
+	return len(r.AppIDs) > 0 || len(r.SpaceIDs) > 0
+}
+
+// Rules are evaluated in order. The first matching rule is applied.
+type Rules []Rule
+
+// UnmarshalEnv reads the rules as a JSON array.
+func (r *Rules) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(data), r)
+}
+
+// RoleFetcher looks up the space roles of a user.
+type RoleFetcher interface {
+	SpaceRoles(token, userID string) ([]string, error)
+}
+
+// Policy authorizes requests against a set of rules.
+type Policy struct {
+	rules Rules
+	f     RoleFetcher
+	log   logger.Logger
+}
+
+func New(rules Rules, f RoleFetcher, log logger.Logger) *Policy {
+	return &Policy{
+		rules: rules,
+		f:     f,
+		log:   log,
+	}
+}
+
+// Authorize reports whether the request's (already validated) token or
+// client certificate (read from the request's context) is allowed to make
+// the request. If not, the reason is returned. Requests that do not match
+// any rule are allowed. An error is returned if the decision can not be made
+// (e.g., CAPI is unavailable).
+func (p *Policy) Authorize(r *http.Request) (bool, string, error) {
+	rule, ok := p.match(r)
+	if !ok {
+		return true, "", nil
+	}
+
+	cert, hasCert := identity.FromContext(r.Context())
+	if rule.requiresCert() {
+		if !hasCert {
+			return false, "requires a client certificate", nil
+		}
+
+		if len(rule.AppIDs) > 0 && !contains(rule.AppIDs, cert.AppID) {
+			return false, fmt.Sprintf("app %s is not allowed", cert.AppID), nil
+		}
+
+		if len(rule.SpaceIDs) > 0 && !contains(rule.SpaceIDs, cert.SpaceID) {
+			return false, fmt.Sprintf("space %s is not allowed", cert.SpaceID), nil
+		}
+	}
+
+	if !rule.requiresToken() {
+		return true, "", nil
+	}
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return false, "requires a token: client certificates have no scopes, client ID or user", nil
+	}
+
+	i, err := identity.FromToken(token)
+	if err != nil {
+		return false, "unable to read token claims", nil
+	}
+
+	for _, scope := range rule.Scopes {
+		if !i.HasScope(scope) {
+			return false, fmt.Sprintf("missing required scope %s", scope), nil
+		}
+	}
+
+	if len(rule.ClientIDs) > 0 && !contains(rule.ClientIDs, i.ClientID) {
+		return false, fmt.Sprintf("client %s is not allowed", i.ClientID), nil
+	}
+
+	if len(rule.SpaceRoles) > 0 {
+		if i.UserID == "" {
+			return false, "space role required but token has no user", nil
+		}
+
+		roles, err := p.f.SpaceRoles(token, i.UserID)
+		if err != nil {
+			p.log.Errorf("failed to fetch space roles: %s", err)
+			return false, "", errors.New("unable to determine space roles")
+		}
+
+		if !containsAny(rule.SpaceRoles, roles) {
+			return false, fmt.Sprintf("requires one of the space roles: %s", strings.Join(rule.SpaceRoles, ", ")), nil
+		}
+	}
+
+	return true, "", nil
+}
+
+func (p *Policy) match(r *http.Request) (Rule, bool) {
+	for _, rule := range p.rules {
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+			continue
+		}
+
+		if MatchPath(rule.Path, r.URL.Path) {
+			return rule, true
+		}
+	}
+
+	return Rule{}, false
+}
+
+// MatchPath reports whether the path matches the pattern. Each segment is
+// matched with path.Match and a final "**" segment matches any remaining
+// segments.
+func MatchPath(pattern, p string) bool {
+	patterns := strings.Split(strings.Trim(pattern, "/"), "/")
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+
+	for i, pat := range patterns {
+		if pat == "**" && i == len(patterns)-1 {
+			return true
+		}
+
+		if i >= len(segments) {
+			return false
+		}
+
+		if ok, _ := path.Match(pat, segments[i]); !ok {
+			return false
+		}
+	}
+
+	return len(patterns) == len(segments)
+}
+
+func contains(values []string, v string) bool {
+	for _, vv := range values {
+		if vv == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsFold(values []string, v string) bool {
+	for _, vv := range values {
+		if strings.EqualFold(vv, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsAny(values, others []string) bool {
+	for _, o := range others {
+		if contains(values, o) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,217 @@
+package policy_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/policy"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TP struct {
+	*testing.T
+	spyRoleFetcher *spyRoleFetcher
+	p              *policy.Policy
+}
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TP {
+		spyRoleFetcher := newSpyRoleFetcher()
+		return TP{
+			T:              t,
+			spyRoleFetcher: spyRoleFetcher,
+			p: policy.New(
+				policy.Rules{
+					{Path: "/admin/**", Methods: []string{"POST", "PUT"}, SpaceRoles: []string{"developer", "manager"}},
+					{Path: "/v1/*/jobs", Scopes: []string{"jobs.write", "jobs.read"}},
+					{Path: "/internal/**", ClientIDs: []string{"some-client"}},
+					{Path: "/peers/**", AppIDs: []string{"some-app"}, SpaceIDs: []string{"some-space"}},
+				},
+				spyRoleFetcher,
+				logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+			),
+		}
+	})
+
+	o.Spec("allows requests that do not match a rule", func(t TP) {
+		ok, reason, _ := t.p.Authorize(newRequest(t.T, "GET", "/admin/users", jwt.MapClaims{}))
+		Expect(t, ok).To(BeTrue())
+		Expect(t, reason).To(Equal(""))
+
+		ok, _, _ = t.p.Authorize(newRequest(t.T, "GET", "/v1/a/b/jobs", jwt.MapClaims{}))
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("requires all of the scopes", func(t TP) {
+		ok, reason, _ := t.p.Authorize(newRequest(t.T, "GET", "/v1/some-id/jobs", jwt.MapClaims{
+			"scope": []string{"jobs.write"},
+		}))
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(ContainSubstring("jobs.read"))
+
+		ok, _, _ = t.p.Authorize(newRequest(t.T, "GET", "/v1/some-id/jobs", jwt.MapClaims{
+			"scope": []string{"jobs.read", "jobs.write"},
+		}))
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("requires one of the client IDs", func(t TP) {
+		ok, reason, _ := t.p.Authorize(newRequest(t.T, "GET", "/internal/a/b", jwt.MapClaims{
+			"client_id": "other-client",
+		}))
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(ContainSubstring("other-client"))
+
+		ok, _, _ = t.p.Authorize(newRequest(t.T, "GET", "/internal", jwt.MapClaims{
+			"client_id": "some-client",
+		}))
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("requires one of the space roles", func(t TP) {
+		t.spyRoleFetcher.roles = []string{"auditor"}
+		ok, reason, _ := t.p.Authorize(newRequest(t.T, "POST", "/admin/users", jwt.MapClaims{
+			"user_id": "some-user",
+		}))
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(ContainSubstring("developer"))
+		Expect(t, t.spyRoleFetcher.userID).To(Equal("some-user"))
+		Expect(t, t.spyRoleFetcher.token).To(StartWith("bearer "))
+
+		t.spyRoleFetcher.roles = []string{"auditor", "developer"}
+		ok, _, _ = t.p.Authorize(newRequest(t.T, "put", "/admin/users", jwt.MapClaims{
+			"user_id": "some-user",
+		}))
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("denies space role rules for tokens without a user", func(t TP) {
+		ok, _, _ := t.p.Authorize(newRequest(t.T, "POST", "/admin/users", jwt.MapClaims{
+			"client_id": "some-client",
+		}))
+		Expect(t, ok).To(BeFalse())
+		Expect(t, t.spyRoleFetcher.userID).To(Equal(""))
+	})
+
+	o.Spec("returns an error if the space roles can not be fetched", func(t TP) {
+		t.spyRoleFetcher.roles = []string{"developer"}
+		t.spyRoleFetcher.err = errors.New("some-error")
+		ok, _, err := t.p.Authorize(newRequest(t.T, "POST", "/admin/users", jwt.MapClaims{
+			"user_id": "some-user",
+		}))
+		Expect(t, ok).To(BeFalse())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("denies matching requests with an unreadable token", func(t TP) {
+		req, err := http.NewRequest("POST", "http://some.url/admin", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("Authorization", "bearer invalid")
+
+		ok, _, _ := t.p.Authorize(req)
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("requires app IDs and space IDs of client certificates", func(t TP) {
+		req := newCertRequest(t.T, "/peers/a", identity.Identity{AppID: "some-app", SpaceID: "some-space"})
+		ok, _, _ := t.p.Authorize(req)
+		Expect(t, ok).To(BeTrue())
+
+		req = newCertRequest(t.T, "/peers/a", identity.Identity{AppID: "other-app", SpaceID: "some-space"})
+		ok, reason, _ := t.p.Authorize(req)
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(Equal("app other-app is not allowed"))
+
+		req = newCertRequest(t.T, "/peers/a", identity.Identity{AppID: "some-app", SpaceID: "other-space"})
+		ok, reason, _ = t.p.Authorize(req)
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(Equal("space other-space is not allowed"))
+	})
+
+	o.Spec("denies tokens for rules that require a client certificate", func(t TP) {
+		ok, reason, _ := t.p.Authorize(newRequest(t.T, "GET", "/peers/a", jwt.MapClaims{}))
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(Equal("requires a client certificate"))
+	})
+
+	o.Spec("denies client certificates for rules that require a token", func(t TP) {
+		req := newCertRequest(t.T, "/v1/some-id/jobs", identity.Identity{AppID: "some-app", SpaceID: "some-space"})
+		ok, reason, err := t.p.Authorize(req)
+		Expect(t, err).To(BeNil())
+		Expect(t, ok).To(BeFalse())
+		Expect(t, reason).To(Equal("requires a token: client certificates have no scopes, client ID or user"))
+	})
+
+	o.Spec("allows requests with a token and a client certificate", func(t TP) {
+		req := newRequest(t.T, "GET", "/v1/some-id/jobs", jwt.MapClaims{
+			"scope": []string{"jobs.write", "jobs.read"},
+		})
+		req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{AppID: "some-app"}))
+		ok, _, _ := t.p.Authorize(req)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("reads the rules from JSON", func(t TP) {
+		var rules policy.Rules
+		err := rules.UnmarshalEnv(`[{"path": "/admin/**", "methods": ["POST"], "space_roles": ["developer"]}, {"path": "/peers/**", "app_ids": ["some-app"], "space_ids": ["some-space"]}]`)
+		Expect(t, err).To(BeNil())
+		Expect(t, rules).To(Equal(policy.Rules{
+			{Path: "/admin/**", Methods: []string{"POST"}, SpaceRoles: []string{"developer"}},
+			{Path: "/peers/**", AppIDs: []string{"some-app"}, SpaceIDs: []string{"some-space"}},
+		}))
+
+		Expect(t, rules.UnmarshalEnv("invalid")).To(Not(BeNil()))
+	})
+}
+
+func newCertRequest(t *testing.T, path string, i identity.Identity) *http.Request {
+	req, err := http.NewRequest("GET", "http://some.url"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return req.WithContext(identity.NewContext(req.Context(), i))
+}
+
+func newRequest(t *testing.T, method, path string, c jwt.MapClaims) *http.Request {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte("some-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(method, "http://some.url"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+
+	return req
+}
+
+type spyRoleFetcher struct {
+	token  string
+	userID string
+	roles  []string
+	err    error
+}
+
+func newSpyRoleFetcher() *spyRoleFetcher {
+	return &spyRoleFetcher{}
+}
+
+func (s *spyRoleFetcher) SpaceRoles(token, userID string) ([]string, error) {
+	s.token = token
+	s.userID = userID
+	return s.roles, s.err
+}
@@ -0,0 +1,280 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+)
+
+// ErrLimited is returned when a request could not be made within the
+// queue timeout.
+var ErrLimited = errors.New("outbound request limit exceeded")
+
+// HostRule limits the requests made to each host that matches Host. Host is
+// either an exact host name, a wildcard (*.some.url) or * for every host.
+// Each host is limited to Rate requests per second (bursts of up to Burst)
+// and MaxConcurrent requests in flight. A zero Rate or MaxConcurrent is
+// unlimited. Requests wait for up to QueueTimeout before failing.
+type HostRule struct {
+	Host          string
+	Rate          float64
+	Burst         int
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+}
+
+// UnmarshalJSON reads the queue timeout as a duration string (e.g., 5s).
+func (r *HostRule) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Host          string  `json:"host"`
+		Rate          float64 `json:"rate"`
+		Burst         int     `json:"burst"`
+		MaxConcurrent int     `json:"max_concurrent"`
+		QueueTimeout  string  `json:"queue_timeout"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*r = HostRule{
+		Host:          v.Host,
+		Rate:          v.Rate,
+		Burst:         v.Burst,
+		MaxConcurrent: v.MaxConcurrent,
+	}
+
+	if v.QueueTimeout != "" {
+		d, err := time.ParseDuration(v.QueueTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid queue timeout for %s: %s", v.Host, err)
+		}
+		r.QueueTimeout = d
+	}
+
+	return nil
+}
+
+func (r HostRule) matches(host string) bool {
+	switch {
+	case r.Host == "*":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(host, r.Host[1:])
+	default:
+		return strings.EqualFold(r.Host, host)
+	}
+}
+
+// label returns the host's metric label. Hosts that only match a wildcard
+// rule are counted as other to keep the number of labels bounded.
+func (r HostRule) label(host string) string {
+	if strings.Contains(r.Host, "*") {
+		return metrics.OtherLabel
+	}
+
+	return host
+}
+
+// HostRules are evaluated in order. The first matching rule is applied.
+type HostRules []HostRule
+
+// UnmarshalEnv reads the rules as a JSON array.
+func (r *HostRules) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+
+	var rules HostRules
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return fmt.Errorf("failed to parse outbound limits: %s", err)
+	}
+	*r = rules
+
+	return nil
+}
+
+// HostLimiter limits the rate and concurrency of requests to each host.
+type HostLimiter struct {
+	rules HostRules
+	log   logger.Logger
+
+	throttled func(delta uint64, labelValues ...string)
+	inFlight  func(value float64, labelValues ...string)
+	queued    func(value float64, labelValues ...string)
+
+	mu    sync.Mutex
+	hosts gcache.Cache
+
+	// Hosts with requests in flight are kept even if the LRU drops them so
+	// that their requests stay counted.
+	busy map[string]*hostState
+
+	// labelInFlight is the number of requests in flight for each label.
+	labelInFlight map[string]int64
+}
+
+type hostState struct {
+	b        bucket
+	sem      chan struct{}
+	inFlight int64
+}
+
+// NewHostLimiter returns a new HostLimiter. The state of up to size hosts is
+// kept (the least recently used are dropped).
+func NewHostLimiter(rules HostRules, size int, m metrics.Metrics, log logger.Logger) *HostLimiter {
+	l := &HostLimiter{
+		rules: rules,
+		log:   log,
+		busy:  make(map[string]*hostState),
+
+		labelInFlight: make(map[string]int64),
+
+		throttled: m.NewLabeledCounter("OutboundThrottled", "host", "reason"),
+		inFlight:  m.NewLabeledGauge("OutboundInFlight", "host"),
+		queued:    m.NewLabeledHistogram("OutboundQueueSeconds", metrics.DefaultBuckets, "host"),
+	}
+
+	// Without rules no host state is kept.
+	if len(rules) > 0 {
+		l.hosts = gcache.New(size).LRU().Build()
+	}
+
+	return l
+}
+
+// Wait blocks until a request can be made to the host. It returns
+// ErrLimited if it waited for longer than the queue timeout (or the context
+// is done first). The returned func must be called once the request is done.
+func (l *HostLimiter) Wait(ctx context.Context, host string) (func(), error) {
+	rule, ok := l.match(host)
+	if !ok {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	s := l.state(rule, host)
+	label := rule.label(host)
+
+	if rule.Rate > 0 {
+		for {
+			ok, wait := s.b.take(rule.Rate, rule.Burst, time.Now())
+			if ok {
+				break
+			}
+
+			if time.Since(start)+wait > rule.QueueTimeout {
+				return nil, l.limited(host, label, "rate")
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, l.limited(host, label, "rate")
+			}
+		}
+	}
+
+	if s.sem != nil {
+		if err := l.acquire(ctx, s, host, label, rule.QueueTimeout-time.Since(start)); err != nil {
+			return nil, err
+		}
+	}
+	l.queued(time.Since(start).Seconds(), label)
+	l.addInFlight(s, host, label, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.addInFlight(s, host, label, -1)
+			if s.sem != nil {
+				<-s.sem
+			}
+		})
+	}, nil
+}
+
+// acquire takes a slot of the host's semaphore, waiting for up to the
+// timeout for one to free up.
+func (l *HostLimiter) acquire(ctx context.Context, s *hostState, host, label string, timeout time.Duration) error {
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout <= 0 {
+		return l.limited(host, label, "concurrency")
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return l.limited(host, label, "concurrency")
+	case <-ctx.Done():
+		return l.limited(host, label, "concurrency")
+	}
+}
+
+func (l *HostLimiter) limited(host, label, reason string) error {
+	l.throttled(1, label, reason)
+	l.log.With(logger.Fields{"host": host, "reason": reason}).Warnf("outbound request limited")
+	return ErrLimited
+}
+
+func (l *HostLimiter) match(host string) (HostRule, bool) {
+	for _, r := range l.rules {
+		if r.matches(host) {
+			return r, true
+		}
+	}
+
+	return HostRule{}, false
+}
+
+func (l *HostLimiter) state(rule HostRule, host string) *hostState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.busy[host]; ok {
+		return s
+	}
+
+	if s, err := l.hosts.GetIFPresent(host); err == nil {
+		return s.(*hostState)
+	}
+
+	s := &hostState{b: bucket{tokens: -1}}
+	if rule.MaxConcurrent > 0 {
+		s.sem = make(chan struct{}, rule.MaxConcurrent)
+	}
+	l.hosts.Set(host, s)
+
+	return s
+}
+
+func (l *HostLimiter) addInFlight(s *hostState, host, label string, delta int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.inFlight += delta
+	l.labelInFlight[label] += delta
+	l.inFlight(float64(l.labelInFlight[label]), label)
+
+	if s.inFlight > 0 {
+		l.busy[host] = s
+	} else {
+		delete(l.busy, host)
+	}
+}
@@ -0,0 +1,184 @@
+package ratelimit_test
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type THL struct {
+	*testing.T
+	l *ratelimit.HostLimiter
+}
+
+func TestHostLimiter(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) THL {
+		return THL{
+			T: t,
+			l: ratelimit.NewHostLimiter(
+				ratelimit.HostRules{
+					{Host: "api.some.url", MaxConcurrent: 1, QueueTimeout: 50 * time.Millisecond},
+					{Host: "*.some.url", Rate: 10, Burst: 1, QueueTimeout: 200 * time.Millisecond},
+					{Host: "slow.url", Rate: 0.001, Burst: 1},
+					{Host: "*.slow.url", Rate: 0.001, Burst: 1},
+					{Host: "*.busy.url", MaxConcurrent: 1},
+				},
+				2,
+				metrics.New(nil),
+				logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+			),
+		}
+	})
+
+	o.Spec("does not limit hosts without a rule", func(t THL) {
+		for i := 0; i < 10; i++ {
+			_, err := t.l.Wait(context.Background(), "other.url")
+			Expect(t, err).To(BeNil())
+		}
+	})
+
+	o.Spec("forgets the least recently used hosts", func(t THL) {
+		release, err := t.l.Wait(context.Background(), "a.slow.url")
+		Expect(t, err).To(BeNil())
+		release()
+		_, err = t.l.Wait(context.Background(), "a.slow.url")
+		Expect(t, err).To(Equal(ratelimit.ErrLimited))
+
+		for _, host := range []string{"b.slow.url", "c.slow.url"} {
+			release, err = t.l.Wait(context.Background(), host)
+			Expect(t, err).To(BeNil())
+			release()
+		}
+
+		_, err = t.l.Wait(context.Background(), "a.slow.url")
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("takes free slots without a queue timeout", func(t THL) {
+		for i := 0; i < 100; i++ {
+			release, err := t.l.Wait(context.Background(), "a.busy.url")
+			Expect(t, err).To(BeNil())
+			release()
+		}
+
+		release, err := t.l.Wait(context.Background(), "a.busy.url")
+		Expect(t, err).To(BeNil())
+		defer release()
+		_, err = t.l.Wait(context.Background(), "a.busy.url")
+		Expect(t, err).To(Equal(ratelimit.ErrLimited))
+	})
+
+	o.Spec("keeps counting requests in flight to forgotten hosts", func(t THL) {
+		release, err := t.l.Wait(context.Background(), "a.busy.url")
+		Expect(t, err).To(BeNil())
+		defer release()
+
+		for _, host := range []string{"b.busy.url", "c.busy.url"} {
+			r, err := t.l.Wait(context.Background(), host)
+			Expect(t, err).To(BeNil())
+			r()
+		}
+
+		_, err = t.l.Wait(context.Background(), "a.busy.url")
+		Expect(t, err).To(Equal(ratelimit.ErrLimited))
+	})
+
+	o.Spec("caps the number of requests in flight", func(t THL) {
+		release, err := t.l.Wait(context.Background(), "api.some.url")
+		Expect(t, err).To(BeNil())
+
+		_, err = t.l.Wait(context.Background(), "api.some.url")
+		Expect(t, err).To(Equal(ratelimit.ErrLimited))
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			release()
+		}()
+
+		release, err = t.l.Wait(context.Background(), "api.some.url")
+		Expect(t, err).To(BeNil())
+		release()
+		release()
+
+		_, err = t.l.Wait(context.Background(), "api.some.url")
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("queues requests until the rate allows them", func(t THL) {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := t.l.Wait(context.Background(), "other.some.url")
+			Expect(t, err).To(BeNil())
+		}
+		Expect(t, time.Since(start) >= 150*time.Millisecond).To(BeTrue())
+	})
+
+	o.Spec("fails requests that would wait past the queue timeout", func(t THL) {
+		_, err := t.l.Wait(context.Background(), "slow.url")
+		Expect(t, err).To(BeNil())
+
+		_, err = t.l.Wait(context.Background(), "slow.url")
+		Expect(t, err).To(Equal(ratelimit.ErrLimited))
+	})
+
+	o.Spec("stops waiting when the context is done", func(t THL) {
+		_, err := t.l.Wait(context.Background(), "api.some.url")
+		Expect(t, err).To(BeNil())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = t.l.Wait(ctx, "api.some.url")
+		Expect(t, err).To(Equal(ratelimit.ErrLimited))
+	})
+
+	o.Spec("counts hosts that only match a wildcard as other", func(t THL) {
+		m := new(expvar.Map).Init()
+		l := ratelimit.NewHostLimiter(
+			ratelimit.HostRules{
+				{Host: "slow.url", Rate: 0.001, Burst: 1},
+				{Host: "*.slow.url", Rate: 0.001, Burst: 1},
+			},
+			10,
+			metrics.New(m),
+			logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		)
+
+		for _, host := range []string{"slow.url", "a.slow.url", "b.slow.url"} {
+			l.Wait(context.Background(), host)
+			l.Wait(context.Background(), host)
+		}
+
+		throttled := m.Get("OutboundThrottled").(*expvar.Map)
+		Expect(t, throttled.Get("host=slow.url,reason=rate").String()).To(Equal("1"))
+		Expect(t, throttled.Get("host=other,reason=rate").String()).To(Equal("2"))
+		Expect(t, throttled.Get("host=a.slow.url,reason=rate")).To(BeNil())
+
+		inFlight := m.Get("OutboundInFlight").(*expvar.Map)
+		Expect(t, inFlight.Get("host=other").String()).To(Equal("2"))
+	})
+
+	o.Spec("reads the rules from JSON", func(t THL) {
+		var rules ratelimit.HostRules
+		Expect(t, rules.UnmarshalEnv(`[{"host": "*.some.url", "rate": 5, "burst": 10, "max_concurrent": 2, "queue_timeout": "3s"}]`)).To(BeNil())
+		Expect(t, rules).To(Equal(ratelimit.HostRules{
+			{Host: "*.some.url", Rate: 5, Burst: 10, MaxConcurrent: 2, QueueTimeout: 3 * time.Second},
+		}))
+
+		var rule ratelimit.HostRule
+		Expect(t, json.Unmarshal([]byte(`{"queue_timeout": "invalid"}`), &rule)).To(Not(BeNil()))
+	})
+}
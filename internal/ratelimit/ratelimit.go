@@ -0,0 +1,214 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/policy"
+)
+
+// Rule limits each caller to Rate requests per second (with bursts of up to
+// Burst requests) for requests whose path matches Path (see
+// policy.MatchPath) and whose method is one of Methods (any method if
+// empty).
+type Rule struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+
+	// Key is what identifies a caller: user_id, client_id, app_id or
+	// identity (default). identity uses the first of the user ID, client ID
+	// and app ID that is set.
+	Key string `json:"key"`
+
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Rules are evaluated in order. The first matching rule is applied.
+type Rules []Rule
+
+// UnmarshalEnv reads the rules as a JSON array.
+func (r *Rules) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+
+	var rules Rules
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return fmt.Errorf("failed to parse rate limits: %s", err)
+	}
+
+	for _, rule := range rules {
+		switch rule.Key {
+		case "", "identity", "user_id", "client_id", "app_id":
+		default:
+			return fmt.Errorf("unknown rate limit key: %s", rule.Key)
+		}
+
+		if rule.Rate <= 0 {
+			return fmt.Errorf("rate limit for %s must have a positive rate", rule.Path)
+		}
+	}
+	*r = rules
+
+	return nil
+}
+
+// Limiter rate limits requests by their caller's identity.
+type Limiter struct {
+	rules   Rules
+	buckets []gcache.Cache
+	log     logger.Logger
+
+	throttled func(delta uint64, labelValues ...string)
+	allowed   func(delta uint64, labelValues ...string)
+
+	mu sync.Mutex
+}
+
+// New returns a new Limiter. Each rule keeps a bucket for up to size
+// callers (the least recently used are dropped).
+func New(rules Rules, size int, m metrics.Metrics, log logger.Logger) *Limiter {
+	l := &Limiter{
+		rules: rules,
+		log:   log,
+
+		throttled: m.NewLabeledCounter("RateLimitThrottled", "rule"),
+		allowed:   m.NewLabeledCounter("RateLimitAllowed", "rule"),
+	}
+
+	for range rules {
+		l.buckets = append(l.buckets, gcache.New(size).LRU().Build())
+	}
+
+	return l
+}
+
+// Allow reports whether the request may be made. If not, it returns how
+// long the caller should wait. The caller is read from the token or the
+// client certificate in the request's context, so requests must already be
+// validated. A rule is skipped if the request has no identity for its key.
+// Requests that do not match any rule are allowed.
+func (l *Limiter) Allow(r *http.Request) (bool, time.Duration) {
+	for idx, rule := range l.rules {
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+			continue
+		}
+
+		if !policy.MatchPath(rule.Path, r.URL.Path) {
+			continue
+		}
+
+		key := callerKey(rule.Key, r)
+		if key == "" {
+			continue
+		}
+
+		ok, wait := l.bucket(idx, key).take(rule.Rate, rule.Burst, time.Now())
+		if !ok {
+			l.throttled(1, rule.Path)
+			l.log.With(logger.Fields{"rule": rule.Path, "caller": key}).Debugf("rate limited request")
+			return false, wait
+		}
+		l.allowed(1, rule.Path)
+
+		return true, 0
+	}
+
+	return true, 0
+}
+
+func (l *Limiter) bucket(idx int, key string) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, err := l.buckets[idx].GetIFPresent(key); err == nil {
+		return b.(*bucket)
+	}
+
+	b := &bucket{tokens: -1}
+	l.buckets[idx].Set(key, b)
+	return b
+}
+
+func callerKey(name string, r *http.Request) string {
+	var i identity.Identity
+	if token := r.Header.Get("Authorization"); token != "" {
+		i, _ = identity.FromToken(token)
+	}
+
+	if c, ok := identity.FromContext(r.Context()); ok {
+		i.AppID = c.AppID
+	}
+
+	switch name {
+	case "user_id":
+		return prefix("user:", i.UserID)
+	case "client_id":
+		return prefix("client:", i.ClientID)
+	case "app_id":
+		return prefix("app:", i.AppID)
+	default:
+		for _, k := range []string{prefix("user:", i.UserID), prefix("client:", i.ClientID), prefix("app:", i.AppID)} {
+			if k != "" {
+				return k
+			}
+		}
+		return ""
+	}
+}
+
+func prefix(p, v string) string {
+	if v == "" {
+		return ""
+	}
+
+	return p + v
+}
+
+// bucket is a token bucket. A negative number of tokens means the bucket
+// has not been used yet (and is full).
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(rate float64, burst int, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	capacity := math.Max(float64(burst), 1)
+	if b.tokens < 0 {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func containsFold(values []string, v string) bool {
+	for _, vv := range values {
+		if strings.EqualFold(vv, v) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+package ratelimit_test
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TL struct {
+	*testing.T
+	m *expvar.Map
+	l *ratelimit.Limiter
+}
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TL {
+		m := new(expvar.Map).Init()
+		return TL{
+			T: t,
+			m: m,
+			l: ratelimit.New(
+				ratelimit.Rules{
+					{Path: "/jobs/**", Methods: []string{"POST"}, Key: "client_id", Rate: 1, Burst: 2},
+					{Path: "/**", Rate: 0.001, Burst: 1},
+				},
+				100,
+				metrics.New(m),
+				logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+			),
+		}
+	})
+
+	o.Spec("allows bursts and then throttles each caller", func(t TL) {
+		req := newRequest(t.T, "POST", "/jobs/a", jwt.MapClaims{"client_id": "some-client"})
+
+		ok, _ := t.l.Allow(req)
+		Expect(t, ok).To(BeTrue())
+		ok, _ = t.l.Allow(req)
+		Expect(t, ok).To(BeTrue())
+
+		ok, wait := t.l.Allow(req)
+		Expect(t, ok).To(BeFalse())
+		Expect(t, wait > 0).To(BeTrue())
+		Expect(t, wait <= time.Second).To(BeTrue())
+
+		other := newRequest(t.T, "POST", "/jobs/a", jwt.MapClaims{"client_id": "other-client"})
+		ok, _ = t.l.Allow(other)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("refills the bucket over time", func(t TL) {
+		req := newRequest(t.T, "POST", "/jobs/a", jwt.MapClaims{"client_id": "some-client"})
+		t.l.Allow(req)
+		t.l.Allow(req)
+
+		time.Sleep(time.Second)
+		ok, _ := t.l.Allow(req)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("uses the first matching rule", func(t TL) {
+		req := newRequest(t.T, "GET", "/jobs/a", jwt.MapClaims{"user_id": "some-user", "client_id": "some-client"})
+
+		ok, _ := t.l.Allow(req)
+		Expect(t, ok).To(BeTrue())
+
+		ok, wait := t.l.Allow(req)
+		Expect(t, ok).To(BeFalse())
+		Expect(t, wait > time.Minute).To(BeTrue())
+
+		// Keyed by user ID, not client ID
+		ok, _ = t.l.Allow(newRequest(t.T, "GET", "/jobs/a", jwt.MapClaims{"user_id": "other-user", "client_id": "some-client"}))
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("keys requests by their client certificate's app", func(t TL) {
+		req, err := http.NewRequest("GET", "http://some.url/a", nil)
+		Expect(t, err).To(BeNil())
+		req = req.WithContext(identity.NewContext(req.Context(), identity.Identity{AppID: "some-app"}))
+
+		ok, _ := t.l.Allow(req)
+		Expect(t, ok).To(BeTrue())
+		ok, _ = t.l.Allow(req)
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("allows requests without an identity", func(t TL) {
+		req, err := http.NewRequest("GET", "http://some.url/a", nil)
+		Expect(t, err).To(BeNil())
+
+		for i := 0; i < 3; i++ {
+			ok, _ := t.l.Allow(req)
+			Expect(t, ok).To(BeTrue())
+		}
+	})
+
+	o.Spec("skips rules without the identity of their key", func(t TL) {
+		req := newRequest(t.T, "POST", "/jobs/a", jwt.MapClaims{"user_id": "some-user"})
+
+		ok, _ := t.l.Allow(req)
+		Expect(t, ok).To(BeTrue())
+		ok, _ = t.l.Allow(req)
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("records throttled requests", func(t TL) {
+		req := newRequest(t.T, "GET", "/a", jwt.MapClaims{"user_id": "some-user"})
+		t.l.Allow(req)
+		t.l.Allow(req)
+
+		throttled := t.m.Get("RateLimitThrottled").(*expvar.Map).Get("rule=/**")
+		Expect(t, throttled.String()).To(Equal("1"))
+		allowed := t.m.Get("RateLimitAllowed").(*expvar.Map).Get("rule=/**")
+		Expect(t, allowed.String()).To(Equal("1"))
+	})
+
+	o.Spec("reads the rules from JSON", func(t TL) {
+		var rules ratelimit.Rules
+		Expect(t, rules.UnmarshalEnv(`[{"path": "/**", "key": "app_id", "rate": 10, "burst": 20}]`)).To(BeNil())
+		Expect(t, rules).To(Equal(ratelimit.Rules{
+			{Path: "/**", Key: "app_id", Rate: 10, Burst: 20},
+		}))
+
+		Expect(t, rules.UnmarshalEnv(`[{"path": "/**", "key": "invalid", "rate": 10}]`)).To(Not(BeNil()))
+		Expect(t, rules.UnmarshalEnv(`[{"path": "/**"}]`)).To(Not(BeNil()))
+		Expect(t, rules.UnmarshalEnv(`invalid`)).To(Not(BeNil()))
+	})
+}
+
+func newRequest(t *testing.T, method, path string, c jwt.MapClaims) *http.Request {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte("some-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(method, "http://some.url"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+
+	return req
+}
@@ -0,0 +1,249 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+)
+
+// Policy configures how requests are retried.
+type Policy struct {
+	// MaxAttempts is the total number of attempts (including the first).
+	// Values of 1 or less disable retries.
+	MaxAttempts int
+
+	// BaseDelay is doubled for each attempt (with jitter) up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// BudgetRatio is the number of retries each request earns for its
+	// upstream host (e.g., 0.2 allows 1 retry for every 5 requests). The
+	// budget keeps retries from piling onto an upstream that is down.
+	BudgetRatio float64
+
+	// BudgetHosts is the number of hosts whose budgets are kept. The least
+	// recently used hosts are forgotten and start over with a full
+	// budget. Values of 0 or less use defaultBudgetHosts.
+	BudgetHosts int
+}
+
+const defaultBudgetHosts = 10000
+
+// maxBudget is the most retries a host can save up.
+const maxBudget = 10
+
+// Retrier retries idempotent requests on connection errors, 429, 502, 503
+// and 504 responses.
+type Retrier struct {
+	p   Policy
+	log logger.Logger
+
+	retries   func(delta uint64, labelValues ...string)
+	exhausted func(delta uint64, labelValues ...string)
+
+	mu      sync.Mutex
+	budgets gcache.Cache
+	rand    *rand.Rand
+}
+
+func New(p Policy, m metrics.Metrics, log logger.Logger) *Retrier {
+	size := p.BudgetHosts
+	if size <= 0 {
+		size = defaultBudgetHosts
+	}
+
+	return &Retrier{
+		p:       p,
+		log:     log,
+		budgets: gcache.New(size).LRU().Build(),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		retries:   m.NewLabeledCounter("UpstreamRetries", "host", "reason"),
+		exhausted: m.NewLabeledCounter("UpstreamRetryBudgetExhausted", "host"),
+	}
+}
+
+// Wrap returns a RoundTripper that retries requests made with rt.
+func (r *Retrier) Wrap(rt http.RoundTripper) http.RoundTripper {
+	if r.p.MaxAttempts <= 1 {
+		return rt
+	}
+
+	return &transport{r: r, rt: rt}
+}
+
+type transport struct {
+	r  *Retrier
+	rt http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	t.r.deposit(host)
+
+	if !retryable(req) {
+		return t.rt.RoundTrip(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.rt.RoundTrip(req)
+
+		reason, retryAfter := shouldRetry(resp, err)
+		if reason == "" || attempt >= t.r.p.MaxAttempts {
+			return resp, err
+		}
+
+		delay := t.r.backoff(attempt)
+		if retryAfter > 0 {
+			if retryAfter > t.r.p.MaxDelay {
+				return resp, err
+			}
+			delay = retryAfter
+		}
+
+		if !t.r.withdraw(host) {
+			t.r.exhausted(1, host)
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		t.r.retries(1, host, reason)
+		t.r.log.With(logger.Fields{
+			"host":    host,
+			"reason":  reason,
+			"attempt": attempt,
+			"delay":   delay.String(),
+		}).Debugf("retrying upstream request")
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// retryable reports whether the request is idempotent and can be sent
+// again.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// shouldRetry returns why the request should be retried (empty if it
+// should not) and how long the upstream asked to wait.
+func shouldRetry(resp *http.Response, err error) (string, time.Duration) {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return "error", 0
+		}
+		return "", 0
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return strconv.Itoa(resp.StatusCode), parseRetryAfter(resp.Header.Get("Retry-After"))
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode), 0
+	default:
+		return "", 0
+	}
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// backoff returns the delay before the given attempt's retry. Half of the
+// delay is random.
+func (r *Retrier) backoff(attempt int) time.Duration {
+	d := r.p.BaseDelay << uint(attempt-1)
+	if d > r.p.MaxDelay || d <= 0 {
+		d = r.p.MaxDelay
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + r.rand.Int63n(half+1))
+}
+
+func (r *Retrier) deposit(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.budget(host)
+	b += r.p.BudgetRatio
+	if b > maxBudget {
+		b = maxBudget
+	}
+	r.budgets.Set(host, b)
+}
+
+func (r *Retrier) withdraw(host string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := r.budget(host)
+	if b < 1 {
+		return false
+	}
+	r.budgets.Set(host, b-1)
+
+	return true
+}
+
+// budget returns the host's budget. Hosts that are not known start with a
+// full budget. It must be called with mu held.
+func (r *Retrier) budget(host string) float64 {
+	b, err := r.budgets.GetIFPresent(host)
+	if err != nil {
+		return maxBudget
+	}
+
+	return b.(float64)
+}
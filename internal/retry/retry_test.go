@@ -0,0 +1,237 @@
+package retry_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/retry"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TR struct {
+	*testing.T
+	spyRoundTripper *spyRoundTripper
+	rt              http.RoundTripper
+}
+
+func TestRetrier(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TR {
+		spyRoundTripper := newSpyRoundTripper()
+		return TR{
+			T:               t,
+			spyRoundTripper: spyRoundTripper,
+			rt: retry.New(
+				retry.Policy{
+					MaxAttempts: 3,
+					BaseDelay:   time.Millisecond,
+					MaxDelay:    10 * time.Millisecond,
+					BudgetRatio: 0.1,
+				},
+				metrics.New(nil),
+				logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+			).Wrap(spyRoundTripper),
+		}
+	})
+
+	o.Spec("does not retry successful requests", func(t TR) {
+		resp, err := t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(200))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(1))
+	})
+
+	o.Spec("retries connection errors", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+		}
+
+		resp, err := t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(200))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(2))
+	})
+
+	o.Spec("does not retry other errors", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{err: errors.New("some-error")},
+		}
+
+		_, err := t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(1))
+	})
+
+	o.Spec("retries 502, 503 and 504 up to the max attempts", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{code: 502}, {code: 503}, {code: 504},
+		}
+
+		resp, err := t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(504))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(3))
+	})
+
+	o.Spec("honors Retry-After for 429s", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{code: 429, retryAfter: "0"},
+		}
+
+		resp, err := t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(200))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(2))
+	})
+
+	o.Spec("does not retry if Retry-After is beyond the max delay", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{code: 429, retryAfter: "60"},
+		}
+
+		resp, err := t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(429))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(1))
+	})
+
+	o.Spec("does not retry non-idempotent methods", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{code: 503},
+		}
+
+		resp, err := t.rt.RoundTrip(newRequest(t.T, "POST", ""))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(503))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(1))
+	})
+
+	o.Spec("replays the body", func(t TR) {
+		t.spyRoundTripper.results = []result{
+			{code: 503},
+		}
+
+		_, err := t.rt.RoundTrip(newRequest(t.T, "PUT", "some-body"))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyRoundTripper.bodies).To(Equal([]string{"some-body", "some-body"}))
+	})
+
+	o.Spec("stops retrying once the budget is spent", func(t TR) {
+		for i := 0; i < 20; i++ {
+			t.spyRoundTripper.results = append(t.spyRoundTripper.results, result{code: 503})
+		}
+
+		for i := 0; i < 10; i++ {
+			t.rt.RoundTrip(newRequest(t.T, "GET", ""))
+		}
+
+		// Each request is attempted once plus the 10 retries a host starts
+		// with.
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(20))
+	})
+
+	o.Spec("forgets the budgets of the least recently used hosts", func(t TR) {
+		rt := retry.New(
+			retry.Policy{
+				MaxAttempts: 2,
+				BaseDelay:   time.Millisecond,
+				MaxDelay:    time.Millisecond,
+				BudgetHosts: 1,
+			},
+			metrics.New(nil),
+			logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		).Wrap(t.spyRoundTripper)
+
+		for i := 0; i < 40; i++ {
+			t.spyRoundTripper.results = append(t.spyRoundTripper.results, result{code: 503})
+		}
+
+		for i := 0; i < 10; i++ {
+			rt.RoundTrip(newRequest(t.T, "GET", ""))
+		}
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(20))
+
+		req := newRequest(t.T, "GET", "")
+		req.URL.Host = "other.url"
+		rt.RoundTrip(req)
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(22))
+
+		rt.RoundTrip(newRequest(t.T, "GET", ""))
+		Expect(t, t.spyRoundTripper.bodies).To(HaveLen(24))
+	})
+}
+
+func newRequest(t *testing.T, method, body string) *http.Request {
+	req, err := http.NewRequest(method, "http://some.url/v1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body == "" {
+		req.Body = nil
+		req.GetBody = nil
+	}
+
+	return req
+}
+
+type result struct {
+	code       int
+	retryAfter string
+	err        error
+}
+
+type spyRoundTripper struct {
+	mu      sync.Mutex
+	results []result
+	bodies  []string
+}
+
+func newSpyRoundTripper() *spyRoundTripper {
+	return &spyRoundTripper{}
+}
+
+func (s *spyRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body []byte
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+	s.bodies = append(s.bodies, string(body))
+
+	res := result{code: 200}
+	if len(s.results) > 0 {
+		res = s.results[0]
+		s.results = s.results[1:]
+	}
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	resp := &http.Response{
+		StatusCode: res.code,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+	if res.retryAfter != "" {
+		resp.Header.Set("Retry-After", res.retryAfter)
+	}
+
+	return resp, nil
+}
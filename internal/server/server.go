@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// Server is an http.Server and the listener it serves on.
+type Server struct {
+	*http.Server
+
+	// Listener is optional. Without one, the server listens on its Addr.
+	Listener net.Listener
+}
+
+func (s Server) serve() error {
+	if s.Listener == nil {
+		return s.ListenAndServe()
+	}
+
+	return s.Serve(s.Listener)
+}
+
+// ListenUnix listens on a Unix socket with the given permissions. A stale
+// socket file is removed first; any other file at path is an error. The
+// socket is created in a private (0700) directory and only moved to path
+// once its permissions are set, so it can not be connected to with the
+// default permissions.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".socket")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket file is removed on Close from path instead.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: l, path: path}, nil
+}
+
+// removeStaleSocket removes the socket file at path. It refuses to remove
+// anything that is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	return os.Remove(path)
+}
+
+type unixListener struct {
+	net.Listener
+	path string
+
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
+
+// Serve serves each server until the context is done or one of them fails.
+// The servers then stop accepting connections and in-flight requests are
+// given the grace period to finish. The first failure is returned.
+func Serve(ctx context.Context, grace time.Duration, log logger.Logger, servers ...Server) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s Server) {
+			err := s.serve()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			errs <- err
+			cancel()
+		}(s)
+	}
+
+	<-ctx.Done()
+	log.Infof("draining in-flight requests for up to %s", grace)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), grace)
+	defer shutdownCancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s Server) {
+			defer wg.Done()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				log.Warnf("failed to drain %s: %s", s.Addr, err)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	var firstErr error
+	for range servers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,210 @@
+package server_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/server"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TS struct {
+	*testing.T
+	log logger.Logger
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TS {
+		return TS{
+			T:   t,
+			log: logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		}
+	})
+
+	o.Spec("drains in-flight requests once the context is done", func(t TS) {
+		addr := freeAddr(t.T)
+		started := make(chan struct{})
+		s := &http.Server{
+			Addr: addr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte("some-data"))
+			}),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Serve(ctx, time.Second, t.log, server.Server{Server: s})
+		}()
+
+		resps := make(chan *http.Response, 1)
+		go func() {
+			resp, err := getWithRetry("http://" + addr)
+			if err != nil {
+				panic(err)
+			}
+			resps <- resp
+		}()
+
+		<-started
+		cancel()
+
+		resp := <-resps
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("some-data"))
+		Expect(t, <-done).To(BeNil())
+
+		_, err = http.Get("http://" + addr)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("gives up on requests after the grace period", func(t TS) {
+		addr := freeAddr(t.T)
+		started := make(chan struct{})
+		s := &http.Server{
+			Addr: addr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(time.Second)
+			}),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Serve(ctx, 10*time.Millisecond, t.log, server.Server{Server: s})
+		}()
+
+		go getWithRetry("http://" + addr)
+		<-started
+
+		start := time.Now()
+		cancel()
+		Expect(t, <-done).To(BeNil())
+		Expect(t, time.Since(start) < 500*time.Millisecond).To(BeTrue())
+	})
+
+	o.Spec("stops every server when one fails", func(t TS) {
+		addr := freeAddr(t.T)
+		s1 := &http.Server{Addr: addr, Handler: http.NotFoundHandler()}
+		s2 := &http.Server{Addr: "invalid-addr", Handler: http.NotFoundHandler()}
+
+		err := server.Serve(context.Background(), time.Second, t.log, server.Server{Server: s1}, server.Server{Server: s2})
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("serves on a Unix socket", func(t TS) {
+		dir, err := ioutil.TempDir("", "server")
+		Expect(t, err).To(BeNil())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "some.sock")
+
+		// A stale socket file is replaced.
+		stale, err := net.Listen("unix", path)
+		Expect(t, err).To(BeNil())
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		l, err := server.ListenUnix(path, 0600)
+		Expect(t, err).To(BeNil())
+
+		info, err := os.Stat(path)
+		Expect(t, err).To(BeNil())
+		Expect(t, info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.Serve(ctx, time.Second, t.log, server.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("some-data"))
+			})},
+			Listener: l,
+		})
+
+		c := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}}
+		resp, err := c.Get("http://unix/")
+		Expect(t, err).To(BeNil())
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("some-data"))
+	})
+
+	o.Spec("does not remove files that are not sockets", func(t TS) {
+		dir, err := ioutil.TempDir("", "server")
+		Expect(t, err).To(BeNil())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "some.sock")
+		Expect(t, ioutil.WriteFile(path, []byte("some-data"), 0600)).To(BeNil())
+
+		_, err = server.ListenUnix(path, 0600)
+		Expect(t, err).To(Not(BeNil()))
+
+		data, err := ioutil.ReadFile(path)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("some-data"))
+	})
+
+	o.Spec("only leaves the socket file", func(t TS) {
+		dir, err := ioutil.TempDir("", "server")
+		Expect(t, err).To(BeNil())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "some.sock")
+
+		l, err := server.ListenUnix(path, 0600)
+		Expect(t, err).To(BeNil())
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(t, err).To(BeNil())
+		Expect(t, files).To(HaveLen(1))
+		Expect(t, files[0].Name()).To(Equal("some.sock"))
+
+		Expect(t, l.Close()).To(BeNil())
+		_, err = os.Stat(path)
+		Expect(t, os.IsNotExist(err)).To(BeTrue())
+	})
+}
+
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	return lis.Addr().String()
+}
+
+// getWithRetry retries until the server is listening.
+func getWithRetry(addr string) (*http.Response, error) {
+	var err error
+	for i := 0; i < 100; i++ {
+		var resp *http.Response
+		resp, err = http.Get(addr)
+		if err == nil {
+			return resp, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil, err
+}
@@ -0,0 +1,281 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/accesslog"
+	"github.com/poy/cf-space-security/internal/cache"
+	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/health"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/cf-space-security/internal/retry"
+	"github.com/poy/cf-space-security/internal/server"
+	"github.com/poy/cf-space-security/internal/transport"
+	"github.com/cloudfoundry-incubator/uaago"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// NewProxy returns the proxy's servers: PORT, the Unix socket and the
+// tokens endpoint (each if enabled).
+func NewProxy(cfg ProxyConfig, s *Sidecar) []server.Server {
+	log := s.Log
+
+	uaa, err := uaago.NewClient(cfg.UAAAddr)
+	if err != nil {
+		log.Fatalf("failed to create UAA client to %s: %s", cfg.UAAAddr, err)
+	}
+
+	// The refresh token is read by the health checks.
+	var refreshMu sync.Mutex
+	refreshToken := func() string {
+		refreshMu.Lock()
+		defer refreshMu.Unlock()
+		return cfg.RefreshToken
+	}
+
+	tokenFetcher := handlers.TokenFetcherFunc(func() string {
+		refToken, accessToken, err := uaa.GetRefreshToken(cfg.ClientID, refreshToken(), cfg.SkipSSLValidation)
+		if err != nil {
+			log.Fatalf("failed to get refresh token: %s", err)
+		}
+
+		refreshMu.Lock()
+		cfg.RefreshToken = refToken
+		refreshMu.Unlock()
+		return accessToken
+	})
+
+	tokenAnalyzer := handlers.TokenAnalyzerFunc(func(token string) bool {
+		expiresAt, err := tokenExpiry(token)
+		if err != nil {
+			log.Fatalf("failed to parse JWT: %s", err)
+		}
+		return expiresAt.Before(time.Now())
+	})
+
+	// The shared client is also used by the reverse proxy, so it is never
+	// told to skip SSL validation.
+	client := s.Client
+	if cfg.SkipSSLValidation {
+		client = transport.NewClient(transport.Config{
+			SkipSSLValidation:     true,
+			DialTimeout:           cfg.ClientDialTimeout,
+			TLSHandshakeTimeout:   cfg.ClientTLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.ClientResponseHeaderTimeout,
+		}, cfg.ClientTimeout)
+	}
+
+	restager := capi.NewRestager(cfg.VcapApplication.ApplicationID, cfg.VcapApplication.CAPIAddr, tokenFetcher, client, log)
+	s.Go(func(ctx context.Context) {
+		refreshTokenWatchdog(ctx, refreshToken, restager, log)
+	})
+
+	cacheCreator := func(f func(*http.Request) http.Handler) *cache.Cache {
+		return cache.New(cfg.CacheSize, cfg.CacheExpiration, f, s.Metrics, log)
+	}
+
+	ds := domains(cfg, log)
+	log.Infof("Proxying for domains: %s", strings.Join(ds, ", "))
+
+	proxy := handlers.NewProxy(
+		transport.NewPool(transport.Config{
+			SkipSSLValidation:     cfg.SkipSSLValidation,
+			IgnoreProxyEnv:        true,
+			MaxIdleConnsPerHost:   cfg.UpstreamMaxIdleConnsPerHost,
+			MaxConnsPerHost:       cfg.UpstreamMaxConnsPerHost,
+			DialTimeout:           cfg.UpstreamDialTimeout,
+			KeepAlive:             30 * time.Second,
+			IdleConnTimeout:       cfg.UpstreamIdleConnTimeout,
+			TLSHandshakeTimeout:   cfg.UpstreamTLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.UpstreamResponseHeaderTimeout,
+			Timeout:               cfg.UpstreamTimeout,
+			HTTP2:                 cfg.UpstreamHTTP2,
+		}),
+		ds,
+		tokenFetcher,
+		cacheCreator,
+		tokenAnalyzer,
+		ratelimit.NewHostLimiter(cfg.OutboundLimits, cfg.OutboundLimitCacheSize, s.Metrics, log),
+		retry.New(retry.Policy{
+			MaxAttempts: cfg.RetryMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+			BudgetRatio: cfg.RetryBudgetRatio,
+		}, s.Metrics, log),
+		s.Metrics,
+		accesslog.New(os.Stdout, cfg.AccessLogSampleRate, log),
+		s.Tracer,
+		log,
+	)
+
+	// The reverse proxy (if any) calls CAPI through the proxy, unless that
+	// would skip verifying CAPI's certificate.
+	if !cfg.SkipSSLValidation {
+		s.proxy = proxy
+	}
+
+	s.Health.Add("access_token", tokenCheck(proxy.CurrentToken, false))
+	s.Health.Add("refresh_token", tokenCheck(refreshToken, true))
+	s.Health.Add("cache", health.Info(func() interface{} {
+		return proxy.CacheStats()
+	}))
+
+	var servers []server.Server
+	if cfg.Port != 0 {
+		log.Infof("Listening on %d", cfg.Port)
+		servers = append(servers, s.NewServer(fmt.Sprintf(":%d", cfg.Port), proxy))
+	}
+
+	if cfg.Socket != "" {
+		srv := s.NewServer("", proxy)
+		srv.Listener, err = server.ListenUnix(cfg.Socket, os.FileMode(cfg.SocketMode))
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %s", cfg.Socket, err)
+		}
+		log.Infof("Listening on %s", cfg.Socket)
+		servers = append(servers, srv)
+	}
+
+	if cfg.TokensEnabled {
+		mux := http.NewServeMux()
+		mux.Handle("/tokens", handlers.NewTokens(proxy, cfg.TokensSecret, log))
+		tokens := s.NewServer(cfg.TokensAddr, mux)
+
+		if cfg.TokensSocket != "" {
+			tokens.Listener, err = server.ListenUnix(cfg.TokensSocket, os.FileMode(cfg.TokensSocketMode))
+			if err != nil {
+				log.Fatalf("failed to listen on %s: %s", cfg.TokensSocket, err)
+			}
+			log.Infof("Serving tokens on %s", cfg.TokensSocket)
+		} else {
+			log.Infof("Serving tokens on %s", cfg.TokensAddr)
+		}
+
+		servers = append(servers, tokens)
+	}
+
+	return servers
+}
+
+func domains(cfg ProxyConfig, log logger.Logger) []string {
+	var domains []string
+	history := map[string]bool{}
+
+	appendDomain := func(addr string) {
+		u, err := url.Parse(addr)
+		if err != nil {
+			log.Fatalf("failed tp parse addr (%s): %s", addr, err)
+		}
+
+		result := removeSubdomain(u)
+		if history[result] {
+			return
+		}
+		history[result] = true
+
+		domains = append(domains, result)
+	}
+
+	appendDomain(cfg.VcapApplication.CAPIAddr)
+
+	for _, URI := range cfg.VcapApplication.ApplicationURIs {
+		appendDomain("http://" + URI)
+	}
+
+	return domains
+}
+
+func removeSubdomain(u *url.URL) string {
+	domains := strings.SplitN(u.Host, ".", 2)
+	if len(domains) == 1 {
+		return u.Host
+	}
+
+	return domains[1]
+}
+
+// tokenExpiry returns when the JWT (optionally prefixed with bearer)
+// expires.
+func tokenExpiry(token string) (time.Time, error) {
+	i, err := identity.FromToken(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if i.ExpiresAt.IsZero() {
+		return time.Time{}, errors.New("failed to parse JWT exp")
+	}
+
+	return i.ExpiresAt, nil
+}
+
+// tokenCheck reports whether the token is held and still valid. An expired
+// token only fails the check if it has to be valid (the access token is
+// refreshed on demand).
+func tokenCheck(token func() string, mustBeValid bool) health.CheckFunc {
+	return func(context.Context) health.Status {
+		t := token()
+		if t == "" {
+			return health.Status{Error: "no token"}
+		}
+
+		expiresAt, err := tokenExpiry(t)
+		if err != nil {
+			return health.Status{Error: err.Error()}
+		}
+
+		expiresIn := time.Until(expiresAt)
+		details := map[string]interface{}{
+			"valid":              expiresIn > 0,
+			"expires_in_seconds": int64(expiresIn.Seconds()),
+		}
+		if expiresIn <= 0 && mustBeValid {
+			return health.Status{Error: "token expired", Details: details}
+		}
+
+		return health.Status{OK: true, Details: details}
+	}
+}
+
+// refreshTokenWatchdog restages the app before the refresh token expires.
+// The token is read with the lock that the token fetcher writes it under.
+func refreshTokenWatchdog(ctx context.Context, refToken func() string, r *capi.Restager, log logger.Logger) {
+	jwt.Parse(refToken(), func(token *jwt.Token) (interface{}, error) {
+		claims := token.Claims.(jwt.MapClaims)
+
+		issuedAtF, ok := claims["iat"].(float64)
+		if !ok {
+			log.Fatalf("failed to parse JWT iat")
+		}
+
+		expiresAtF, ok := claims["exp"].(float64)
+		if !ok {
+			log.Fatalf("failed to parse JWT exp")
+		}
+
+		expiresAt := time.Unix(int64(expiresAtF), 0)
+		issuedAt := time.Unix(int64(issuedAtF), 0)
+
+		resetTokenIn := issuedAt.Add(expiresAt.Sub(issuedAt) * 90 / 100).Sub(time.Now())
+		log.Infof("resetting refresh token in %s", resetTokenIn)
+
+		select {
+		case <-time.After(resetTokenIn):
+			r.SetAndRestage()
+		case <-ctx.Done():
+		}
+
+		return nil, nil
+	})
+}
@@ -0,0 +1,169 @@
+package sidecar
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/go-envstruct"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+)
+
+// ProxyConfig configures the proxy.
+type ProxyConfig struct {
+	Port            int           `env:"PORT, report"`
+	HealthPort      int           `env:"PROXY_HEALTH_PORT, report"`
+	CacheSize       int           `env:"CACHE_SIZE, report"`
+	CacheExpiration time.Duration `env:"CACHE_EXPIRATION, report"`
+
+	// The proxy listens on the Unix socket (along with PORT if it is set)
+	Socket     string   `env:"PROXY_SOCKET, report"`
+	SocketMode FileMode `env:"PROXY_SOCKET_MODE, report"`
+
+	VcapApplication VcapApplication `env:"VCAP_APPLICATION, required"`
+
+	ClientID     string `env:"CLIENT_ID, required"`
+	RefreshToken string `env:"REFRESH_TOKEN, required"`
+
+	SkipSSLValidation bool `env:"SKIP_SSL_VALIDATION, report"`
+
+	// The /tokens endpoint serves the current access token. It listens on
+	// TokensAddr (localhost only by default) or, when set, the Unix socket
+	// TokensSocket. With a secret, requests must send it as their bearer
+	// token.
+	TokensEnabled    bool     `env:"TOKENS_ENABLED, report"`
+	TokensAddr       string   `env:"TOKENS_ADDR, report"`
+	TokensSocket     string   `env:"TOKENS_SOCKET, report"`
+	TokensSocketMode FileMode `env:"TOKENS_SOCKET_MODE, report"`
+	TokensSecret     string   `env:"TOKENS_SECRET"`
+
+	// Connections to each upstream host are pooled and reused
+	UpstreamMaxIdleConnsPerHost   int           `env:"UPSTREAM_MAX_IDLE_CONNS_PER_HOST, report"`
+	UpstreamMaxConnsPerHost       int           `env:"UPSTREAM_MAX_CONNS_PER_HOST, report"`
+	UpstreamIdleConnTimeout       time.Duration `env:"UPSTREAM_IDLE_CONN_TIMEOUT, report"`
+	UpstreamDialTimeout           time.Duration `env:"UPSTREAM_DIAL_TIMEOUT, report"`
+	UpstreamTLSHandshakeTimeout   time.Duration `env:"UPSTREAM_TLS_HANDSHAKE_TIMEOUT, report"`
+	UpstreamResponseHeaderTimeout time.Duration `env:"UPSTREAM_RESPONSE_HEADER_TIMEOUT, report"`
+	UpstreamTimeout               time.Duration `env:"UPSTREAM_TIMEOUT, report"`
+	UpstreamHTTP2                 bool          `env:"UPSTREAM_HTTP2, report"`
+
+	// Rules (JSON array) that limit the rate and concurrency of requests to
+	// each upstream host (the state of up to OutboundLimitCacheSize hosts
+	// is kept)
+	OutboundLimits         ratelimit.HostRules `env:"OUTBOUND_LIMITS, report"`
+	OutboundLimitCacheSize int                 `env:"OUTBOUND_LIMIT_CACHE_SIZE, report"`
+
+	// Timeouts of the clients used for CAPI, Loggregator and OpenTelemetry
+	ClientTimeout               time.Duration `env:"CLIENT_TIMEOUT, report"`
+	ClientDialTimeout           time.Duration `env:"CLIENT_DIAL_TIMEOUT, report"`
+	ClientTLSHandshakeTimeout   time.Duration `env:"CLIENT_TLS_HANDSHAKE_TIMEOUT, report"`
+	ClientResponseHeaderTimeout time.Duration `env:"CLIENT_RESPONSE_HEADER_TIMEOUT, report"`
+
+	// Timeouts of the proxy and health servers. A write timeout cuts off
+	// streamed responses and is therefore disabled by default.
+	ServerReadHeaderTimeout time.Duration `env:"SERVER_READ_HEADER_TIMEOUT, report"`
+	ServerReadTimeout       time.Duration `env:"SERVER_READ_TIMEOUT, report"`
+	ServerWriteTimeout      time.Duration `env:"SERVER_WRITE_TIMEOUT, report"`
+	ServerIdleTimeout       time.Duration `env:"SERVER_IDLE_TIMEOUT, report"`
+
+	// How long in-flight requests are given to finish on SIGTERM
+	ShutdownGracePeriod time.Duration `env:"SHUTDOWN_GRACE_PERIOD, report"`
+
+	// Idempotent requests that fail with a connection error, 429, 502, 503
+	// or 504 are retried. A max attempts of 1 disables retries.
+	RetryMaxAttempts int           `env:"RETRY_MAX_ATTEMPTS, report"`
+	RetryBaseDelay   time.Duration `env:"RETRY_BASE_DELAY, report"`
+	RetryMaxDelay    time.Duration `env:"RETRY_MAX_DELAY, report"`
+
+	// Retries each request earns for its upstream host
+	RetryBudgetRatio float64 `env:"RETRY_BUDGET_RATIO, report"`
+
+	LogLevel  logger.Level  `env:"LOG_LEVEL, report"`
+	LogFormat logger.Format `env:"LOG_FORMAT, report"`
+
+	// Fraction (0 to 1) of requests written to the access log
+	AccessLogSampleRate float64 `env:"ACCESS_LOG_SAMPLE_RATE, report"`
+
+	// When set, spans are sent to the OpenTelemetry collector via OTLP/HTTP
+	OTLPAddr          string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT, report"`
+	OTLPFlushInterval time.Duration `env:"OTEL_FLUSH_INTERVAL, report"`
+
+	// When set, metrics are sent to Loggregator
+	LoggregatorIngressURL   string        `env:"LOGGREGATOR_INGRESS_URL, report"`
+	LoggregatorEmitInterval time.Duration `env:"LOGGREGATOR_EMIT_INTERVAL, report"`
+	InstanceIndex           string        `env:"CF_INSTANCE_INDEX, report"`
+
+	// Figured out via VcapApplication
+	UAAAddr string
+}
+
+// FileMode is a file mode given in octal (e.g., 0600).
+type FileMode os.FileMode
+
+// UnmarshalEnv implements envstruct.Unmarshaller.
+func (m *FileMode) UnmarshalEnv(data string) error {
+	mode, err := strconv.ParseUint(data, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q: %s", data, err)
+	}
+
+	*m = FileMode(mode)
+	return nil
+}
+
+func LoadProxyConfig(log logger.Logger) ProxyConfig {
+	cfg := ProxyConfig{
+		HealthPort:      8081,
+		CacheSize:       100,
+		CacheExpiration: time.Minute,
+
+		TokensEnabled:    true,
+		TokensAddr:       "127.0.0.1:8083",
+		TokensSocketMode: 0600,
+		SocketMode:       0600,
+
+		UpstreamMaxIdleConnsPerHost: 100,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+		UpstreamDialTimeout:         30 * time.Second,
+		UpstreamTLSHandshakeTimeout: 10 * time.Second,
+		UpstreamTimeout:             5 * time.Minute,
+		UpstreamHTTP2:               true,
+		OutboundLimitCacheSize:      10000,
+
+		ClientTimeout:               5 * time.Second,
+		ClientDialTimeout:           5 * time.Second,
+		ClientTLSHandshakeTimeout:   5 * time.Second,
+		ClientResponseHeaderTimeout: 5 * time.Second,
+
+		ServerReadHeaderTimeout: 10 * time.Second,
+		ServerIdleTimeout:       2 * time.Minute,
+		ShutdownGracePeriod:     8 * time.Second,
+
+		RetryMaxAttempts: 3,
+		RetryBaseDelay:   50 * time.Millisecond,
+		RetryMaxDelay:    2 * time.Second,
+		RetryBudgetRatio: 0.2,
+
+		LogLevel:                logger.Info,
+		LogFormat:               logger.Text,
+		AccessLogSampleRate:     1,
+		LoggregatorEmitInterval: 15 * time.Second,
+		OTLPFlushInterval:       5 * time.Second,
+	}
+	if err := envstruct.Load(&cfg); err != nil {
+		log.Fatalf("failed to load config: %s", err)
+	}
+
+	if cfg.Port == 0 && cfg.Socket == "" {
+		log.Fatalf("failed to load config: PORT or PROXY_SOCKET is required")
+	}
+
+	cfg.UAAAddr = strings.Replace(cfg.VcapApplication.CAPIAddr, "api", "uaa", 1)
+
+	envstruct.WriteReport(&cfg)
+
+	return cfg
+}
@@ -0,0 +1,201 @@
+package sidecar
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/accesslog"
+	"github.com/poy/cf-space-security/internal/breaker"
+	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/certs"
+	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/health"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/policy"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+	"github.com/poy/cf-space-security/internal/server"
+	"github.com/poy/cf-space-security/internal/transport"
+)
+
+// NewReverseProxy returns the reverse proxy's servers: PORT and TLS_PORT
+// (if enabled). If NewProxy was called first, CAPI is called through the
+// proxy.
+func NewReverseProxy(cfg ReverseProxyConfig, s *Sidecar) []server.Server {
+	log := s.Log
+
+	// Within the sidecar, the proxy serves CAPI requests directly. Otherwise,
+	// with HTTP_PROXY set (e.g., to the proxy), CAPI is called via plain
+	// HTTP so that the proxy can cache its responses. Without a proxy the
+	// callers' tokens must not be sent in the clear.
+	capiAddr := cfg.VcapApplication.CAPIAddr
+	capiClient := s.capiClient()
+	if capiClient == s.Client && (os.Getenv("HTTP_PROXY") != "" || os.Getenv("http_proxy") != "") {
+		capiAddr = strings.Replace(capiAddr, "https", "http", 1)
+	}
+	verifier := identity.NewVerifier(cfg.UAAAddr, s.Client, log)
+	if cfg.CAPIFailureMode == capi.FailOpen {
+		go func() {
+			if err := verifier.Refresh(); err != nil {
+				log.Errorf("failed to fetch UAA token keys: %s", err)
+			}
+		}()
+	}
+
+	capiBreaker := breaker.New("capi", cfg.CAPIBreakerThreshold, cfg.CAPIBreakerCooldown, s.Metrics, log)
+	validator := capi.NewFallbackValidator(
+		capi.NewValidator(
+			cfg.VcapApplication.ApplicationID,
+			capiAddr,
+			capiClient,
+			s.Metrics,
+			log,
+		),
+		capiBreaker,
+		cfg.CAPIFailureMode,
+		cfg.CAPIDecisionCacheSize,
+		cfg.CAPIDecisionCacheTTL,
+		verifier,
+		s.Metrics,
+		log,
+	)
+
+	roleFetcher := capi.NewRoleFetcher(
+		cfg.VcapApplication.SpaceID,
+		capiAddr,
+		cfg.RoleCacheSize,
+		cfg.RoleCacheTTL,
+		capiClient,
+		log,
+	)
+	authorizer := policy.New(cfg.AuthorizationPolicy, roleFetcher, log)
+	forwarder := identity.NewForwarder(cfg.IdentityHeaders, roleFetcher, log)
+
+	log.Infof("Forwarding requests to %s", cfg.BackendURL)
+	backendTransport := transport.New(transport.Config{
+		RootCAs:               loadCAs(cfg.BackendCAFile, log),
+		UnixSocket:            cfg.BackendSocket,
+		DialTimeout:           cfg.BackendDialTimeout,
+		KeepAlive:             30 * time.Second,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: cfg.BackendResponseHeaderTimeout,
+	})
+
+	revProxy := handlers.NewReverseProxy(
+		handlers.NewBackend(cfg.Backend, backendTransport, log),
+		validator,
+		authorizer,
+		forwarder,
+		identity.NewCertAuthenticator(cfg.MTLSAllowedAppIDs, cfg.MTLSAllowedSpaceIDs, cfg.MTLSTrustXFCC),
+		cfg.AuthMode,
+		ratelimit.New(cfg.RateLimits, cfg.RateLimitCacheSize, s.Metrics, log),
+		s.Metrics,
+		accesslog.New(os.Stdout, cfg.AccessLogSampleRate, log),
+		s.Tracer,
+	)
+	controller := handlers.NewController(
+		cfg.OpenEndpoints,
+		identity.StripHandler(cfg.IdentityHeaders, handlers.NewBackend(cfg.Backend, backendTransport, log)),
+		revProxy,
+	)
+
+	s.Health.Add("backend", backendCheck(cfg))
+	s.Health.Add("validation", health.Info(func() interface{} {
+		return map[string]interface{}{
+			"breaker":          capiBreaker.State().String(),
+			"cached_decisions": validator.CachedDecisions(),
+		}
+	}))
+
+	log.Infof("Listening on %d", cfg.Port)
+	servers := []server.Server{
+		s.NewServer(fmt.Sprintf(":%d", cfg.Port), controller),
+	}
+
+	if cfg.TLSPort != 0 {
+		reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, log)
+		if err != nil {
+			log.Fatalf("failed to load instance certificate: %s", err)
+		}
+		s.Go(func(ctx context.Context) {
+			reloader.Run(ctx, cfg.TLSReloadInterval)
+		})
+
+		srv := s.NewServer(fmt.Sprintf(":%d", cfg.TLSPort), controller)
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Fatalf("failed to listen for HTTPS: %s", err)
+		}
+		srv.Listener = tls.NewListener(l, tlsConfig(reloader, cfg.TLSClientCAFile, log))
+		servers = append(servers, srv)
+		log.Infof("Listening for HTTPS on %d", cfg.TLSPort)
+	}
+
+	return servers
+}
+
+// tlsConfig serves the reloader's certificate. Client certificates are
+// verified with the given CA file (if any) so they can be used to
+// authenticate requests.
+func tlsConfig(r *certs.Reloader, clientCAFile string, log logger.Logger) *tls.Config {
+	c := &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	if clientCAFile == "" {
+		return c
+	}
+
+	c.ClientCAs = loadCAs(clientCAFile, log)
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return c
+}
+
+// loadCAs reads the PEM encoded CA certificates. It returns nil (the host's
+// CAs) if the file is not set.
+func loadCAs(file string, log logger.Logger) *x509.CertPool {
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("failed to read CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		log.Fatalf("failed to parse CA file %s", file)
+	}
+
+	return pool
+}
+
+// backendCheck reports whether the application accepts connections.
+func backendCheck(cfg ReverseProxyConfig) health.CheckFunc {
+	if cfg.BackendSocket != "" {
+		return health.DialCheck("unix", cfg.BackendSocket)
+	}
+
+	addr := cfg.Backend.Host
+	if cfg.Backend.Port() == "" {
+		port := "80"
+		if cfg.Backend.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(cfg.Backend.Hostname(), port)
+	}
+
+	return health.DialCheck("tcp", addr)
+}
@@ -0,0 +1,225 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/go-envstruct"
+	"github.com/poy/cf-space-security/internal/capi"
+	"github.com/poy/cf-space-security/internal/handlers"
+	"github.com/poy/cf-space-security/internal/identity"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/policy"
+	"github.com/poy/cf-space-security/internal/ratelimit"
+)
+
+// ReverseProxyConfig configures the reverse proxy.
+type ReverseProxyConfig struct {
+	Port        int `env:"PORT, required, report"`
+	BackendPort int `env:"BACKEND_PORT, report"`
+	HealthPort  int `env:"REVERSE_PROXY_HEALTH_PORT, report"`
+
+	// Where requests are forwarded to (http://, https:// or unix://).
+	// Defaults to http://localhost:<BACKEND_PORT>. HTTPS backends are
+	// verified with the CA certificates (PEM) of BackendCAFile if set.
+	BackendURL    string `env:"BACKEND_URL, report"`
+	BackendCAFile string `env:"BACKEND_CA_FILE, report"`
+
+	// When set, the reverse proxy also listens for HTTPS with the Diego
+	// instance identity certificate. The files are reloaded when Diego
+	// rotates them.
+	TLSPort           int           `env:"TLS_PORT, report"`
+	TLSCertFile       string        `env:"CF_INSTANCE_CERT, report"`
+	TLSKeyFile        string        `env:"CF_INSTANCE_KEY, report"`
+	TLSReloadInterval time.Duration `env:"TLS_RELOAD_INTERVAL, report"`
+
+	// CA certificates (PEM) client certificates are verified with on the
+	// HTTPS listener
+	TLSClientCAFile string `env:"TLS_CLIENT_CA_FILE, report"`
+
+	// Whitelist of endpoints that auth is not required. Either a comma
+	// separated list of paths or a JSON array of handlers.OpenEndpoint.
+	OpenEndpoints handlers.OpenEndpoints `env:"OPEN_ENDPOINTS, report"`
+
+	// JSON file with more open endpoints
+	OpenEndpointsFile string `env:"OPEN_ENDPOINTS_FILE, report"`
+
+	// Rules (JSON array) that restrict endpoints to tokens with the given
+	// scopes, client IDs or space roles or to client certificates of the
+	// given apps or spaces.
+	AuthorizationPolicy policy.Rules `env:"AUTHORIZATION_POLICY, report"`
+
+	// Headers (JSON object) the caller's identity is forwarded to the
+	// application as. Defaults to identity.DefaultHeaders.
+	IdentityHeaders identity.Headers `env:"IDENTITY_HEADERS, report"`
+
+	// Space roles (for policies and identity headers) are cached per user
+	RoleCacheSize int           `env:"ROLE_CACHE_SIZE, report"`
+	RoleCacheTTL  time.Duration `env:"ROLE_CACHE_TTL, report"`
+
+	// How tokens are validated while CAPI is unavailable (closed,
+	// last-known-good or open)
+	CAPIFailureMode       capi.FailureMode `env:"CAPI_FAILURE_MODE, report"`
+	CAPIBreakerThreshold  int              `env:"CAPI_BREAKER_THRESHOLD, report"`
+	CAPIBreakerCooldown   time.Duration    `env:"CAPI_BREAKER_COOLDOWN, report"`
+	CAPIDecisionCacheSize int              `env:"CAPI_DECISION_CACHE_SIZE, report"`
+	CAPIDecisionCacheTTL  time.Duration    `env:"CAPI_DECISION_CACHE_TTL, report"`
+
+	// How requests are authenticated (jwt, mtls, jwt-or-mtls or
+	// jwt-and-mtls)
+	AuthMode handlers.AuthMode `env:"AUTH_MODE, report"`
+
+	// Client certificates (Diego instance identity) from these apps or
+	// spaces are allowed
+	MTLSAllowedAppIDs   []string `env:"MTLS_ALLOWED_APP_IDS, report"`
+	MTLSAllowedSpaceIDs []string `env:"MTLS_ALLOWED_SPACE_IDS, report"`
+
+	// Read the client certificate from the X-Forwarded-Client-Cert header.
+	// Only enable when the header is set by a trusted router.
+	MTLSTrustXFCC bool `env:"MTLS_TRUST_XFCC, report"`
+
+	// Rules (JSON array) that limit how many requests each caller can make
+	RateLimits         ratelimit.Rules `env:"RATE_LIMITS, report"`
+	RateLimitCacheSize int             `env:"RATE_LIMIT_CACHE_SIZE, report"`
+
+	// Timeouts of the clients used for CAPI, UAA, Loggregator and
+	// OpenTelemetry
+	ClientTimeout               time.Duration `env:"CLIENT_TIMEOUT, report"`
+	ClientDialTimeout           time.Duration `env:"CLIENT_DIAL_TIMEOUT, report"`
+	ClientTLSHandshakeTimeout   time.Duration `env:"CLIENT_TLS_HANDSHAKE_TIMEOUT, report"`
+	ClientResponseHeaderTimeout time.Duration `env:"CLIENT_RESPONSE_HEADER_TIMEOUT, report"`
+
+	// Timeouts of requests to the application
+	BackendDialTimeout           time.Duration `env:"BACKEND_DIAL_TIMEOUT, report"`
+	BackendResponseHeaderTimeout time.Duration `env:"BACKEND_RESPONSE_HEADER_TIMEOUT, report"`
+
+	// Timeouts of the reverse proxy and health servers. A write timeout cuts
+	// off streamed responses and is therefore disabled by default.
+	ServerReadHeaderTimeout time.Duration `env:"SERVER_READ_HEADER_TIMEOUT, report"`
+	ServerReadTimeout       time.Duration `env:"SERVER_READ_TIMEOUT, report"`
+	ServerWriteTimeout      time.Duration `env:"SERVER_WRITE_TIMEOUT, report"`
+	ServerIdleTimeout       time.Duration `env:"SERVER_IDLE_TIMEOUT, report"`
+
+	// How long in-flight requests are given to finish on SIGTERM
+	ShutdownGracePeriod time.Duration `env:"SHUTDOWN_GRACE_PERIOD, report"`
+
+	VcapApplication VcapApplication `env:"VCAP_APPLICATION, required"`
+
+	LogLevel  logger.Level  `env:"LOG_LEVEL, report"`
+	LogFormat logger.Format `env:"LOG_FORMAT, report"`
+
+	// Fraction (0 to 1) of requests written to the access log
+	AccessLogSampleRate float64 `env:"ACCESS_LOG_SAMPLE_RATE, report"`
+
+	// When set, spans are sent to the OpenTelemetry collector via OTLP/HTTP
+	OTLPAddr          string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT, report"`
+	OTLPFlushInterval time.Duration `env:"OTEL_FLUSH_INTERVAL, report"`
+
+	// When set, metrics are sent to Loggregator
+	LoggregatorIngressURL   string        `env:"LOGGREGATOR_INGRESS_URL, report"`
+	LoggregatorEmitInterval time.Duration `env:"LOGGREGATOR_EMIT_INTERVAL, report"`
+	InstanceIndex           string        `env:"CF_INSTANCE_INDEX, report"`
+
+	UAAAddr string
+
+	// Backend is parsed from BackendURL. For unix:// URLs it is a
+	// placeholder http URL and BackendSocket is the socket's path.
+	Backend       *url.URL
+	BackendSocket string
+}
+
+type VcapApplication struct {
+	CAPIAddr        string   `json:"cf_api"`
+	ApplicationID   string   `json:"application_id"`
+	ApplicationURIs []string `json:"application_uris"`
+	SpaceID         string   `json:"space_id"`
+}
+
+func (a *VcapApplication) UnmarshalEnv(data string) error {
+	return json.Unmarshal([]byte(data), a)
+}
+
+func LoadReverseProxyConfig(log logger.Logger) ReverseProxyConfig {
+	cfg := ReverseProxyConfig{
+		HealthPort:              8082,
+		IdentityHeaders:         identity.DefaultHeaders,
+		RateLimitCacheSize:      10000,
+		CAPIBreakerThreshold:    5,
+		CAPIBreakerCooldown:     30 * time.Second,
+		CAPIDecisionCacheSize:   10000,
+		CAPIDecisionCacheTTL:    5 * time.Minute,
+		RoleCacheSize:           10000,
+		RoleCacheTTL:            30 * time.Second,
+		LogLevel:                logger.Info,
+		LogFormat:               logger.Text,
+		AccessLogSampleRate:     1,
+		LoggregatorEmitInterval: 15 * time.Second,
+		OTLPFlushInterval:       5 * time.Second,
+
+		ClientTimeout:               5 * time.Second,
+		ClientDialTimeout:           5 * time.Second,
+		ClientTLSHandshakeTimeout:   5 * time.Second,
+		ClientResponseHeaderTimeout: 5 * time.Second,
+		BackendDialTimeout:          5 * time.Second,
+		ServerReadHeaderTimeout:     10 * time.Second,
+		ServerIdleTimeout:           2 * time.Minute,
+		ShutdownGracePeriod:         8 * time.Second,
+		TLSReloadInterval:           time.Minute,
+	}
+	if err := envstruct.Load(&cfg); err != nil {
+		log.Fatalf("failed to load config: %s", err)
+	}
+
+	if cfg.OpenEndpointsFile != "" {
+		data, err := ioutil.ReadFile(cfg.OpenEndpointsFile)
+		if err != nil {
+			log.Fatalf("failed to read open endpoints file: %s", err)
+		}
+
+		var endpoints handlers.OpenEndpoints
+		if err := endpoints.UnmarshalEnv(string(data)); err != nil {
+			log.Fatalf("failed to load open endpoints file: %s", err)
+		}
+		cfg.OpenEndpoints = append(cfg.OpenEndpoints, endpoints...)
+	}
+
+	if cfg.TLSPort != 0 && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		log.Fatalf("TLS_PORT requires CF_INSTANCE_CERT and CF_INSTANCE_KEY")
+	}
+
+	if cfg.BackendURL == "" {
+		if cfg.BackendPort == 0 {
+			log.Fatalf("either BACKEND_URL or BACKEND_PORT is required")
+		}
+		cfg.BackendURL = fmt.Sprintf("http://localhost:%d", cfg.BackendPort)
+	}
+
+	backend, err := url.Parse(cfg.BackendURL)
+	if err != nil {
+		log.Fatalf("failed to parse BACKEND_URL: %s", err)
+	}
+
+	switch backend.Scheme {
+	case "http", "https":
+		cfg.Backend = backend
+	case "unix":
+		// unix://app.sock would parse app.sock as the host.
+		if backend.Host != "" || backend.Path == "" {
+			log.Fatalf("BACKEND_URL must have an absolute socket path (e.g., unix:///home/vcap/tmp/app.sock): %s", cfg.BackendURL)
+		}
+		cfg.Backend = &url.URL{Scheme: "http", Host: "localhost"}
+		cfg.BackendSocket = backend.Path
+	default:
+		log.Fatalf("unsupported BACKEND_URL scheme: %q", backend.Scheme)
+	}
+
+	cfg.UAAAddr = strings.Replace(cfg.VcapApplication.CAPIAddr, "api", "uaa", 1)
+
+	envstruct.WriteReport(&cfg)
+
+	return cfg
+}
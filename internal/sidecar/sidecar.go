@@ -0,0 +1,206 @@
+// Package sidecar wires the proxy and reverse proxy. They can run as their
+// own processes or together in one, sharing their clients, metrics, tracer
+// and health endpoints. Together, the reverse proxy's CAPI requests (token
+// validation and space roles) are served by the proxy and share its GET
+// cache.
+package sidecar
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/health"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/metrics"
+	"github.com/poy/cf-space-security/internal/server"
+	"github.com/poy/cf-space-security/internal/tracing"
+)
+
+// Config configures what the components of a Sidecar share.
+type Config struct {
+	// Name (e.g., reverse-proxy) is used for the Prometheus namespace and
+	// the service name of spans. Metrics are published via expvar as
+	// ExpvarName.
+	Name       string
+	ExpvarName string
+
+	// Client is used for CAPI, UAA, Loggregator and OpenTelemetry.
+	Client *http.Client
+
+	CAPIAddr string
+	UAAAddr  string
+
+	// Each health check is given the timeout.
+	HealthTimeout time.Duration
+
+	// When set, metrics are sent to Loggregator
+	LoggregatorIngressURL   string
+	LoggregatorEmitInterval time.Duration
+	SourceID                string
+	InstanceIndex           string
+
+	// When set, spans are sent to the OpenTelemetry collector via OTLP/HTTP
+	OTLPAddr          string
+	OTLPFlushInterval time.Duration
+
+	ServerReadHeaderTimeout time.Duration
+	ServerReadTimeout       time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+}
+
+// Sidecar holds what its components share.
+type Sidecar struct {
+	Log     logger.Logger
+	Metrics metrics.Metrics
+	Client  *http.Client
+	Tracer  *tracing.Tracer
+	Health  *health.Health
+
+	cfg       Config
+	expvarMap *expvar.Map
+
+	// proxy is set by NewProxy for the reverse proxy's CAPI requests.
+	proxy http.Handler
+
+	ctx    context.Context
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+// New starts the exporters and adds the CAPI and UAA health checks.
+func New(cfg Config, log logger.Logger) *Sidecar {
+	expvarMap := expvar.NewMap(cfg.ExpvarName)
+
+	// Background goroutines are stopped once the servers are drained.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Sidecar{
+		Log:       log,
+		Metrics:   metrics.New(expvarMap),
+		Client:    cfg.Client,
+		Health:    health.New(cfg.HealthTimeout),
+		cfg:       cfg,
+		expvarMap: expvarMap,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	if cfg.LoggregatorIngressURL != "" {
+		log.Infof("Sending metrics to Loggregator (%s)", cfg.LoggregatorIngressURL)
+		e := metrics.NewLoggregatorExporter(
+			cfg.LoggregatorIngressURL,
+			cfg.SourceID,
+			cfg.InstanceIndex,
+			expvarMap,
+			cfg.Client,
+			log,
+		)
+		s.Go(func(ctx context.Context) {
+			e.Run(ctx, cfg.LoggregatorEmitInterval)
+		})
+	}
+
+	var exporter tracing.Exporter
+	if cfg.OTLPAddr != "" {
+		log.Infof("Sending spans to OpenTelemetry collector (%s)", cfg.OTLPAddr)
+		e := tracing.NewOTLPExporter(cfg.OTLPAddr, "cf-space-security-"+cfg.Name, cfg.Client, log)
+		s.Go(func(ctx context.Context) {
+			e.Run(ctx, cfg.OTLPFlushInterval)
+		})
+		exporter = e
+	}
+	s.Tracer = tracing.NewTracer(exporter)
+
+	s.Health.Add("capi", health.HTTPCheck(cfg.Client, cfg.CAPIAddr))
+	s.Health.Add("uaa", health.HTTPCheck(cfg.Client, cfg.UAAAddr+"/healthz"))
+
+	return s
+}
+
+// Go runs f in the background. Its context is done once the servers are
+// drained and Serve waits for f to return.
+func (s *Sidecar) Go(f func(context.Context)) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f(s.ctx)
+	}()
+}
+
+// capiClient returns the client the reverse proxy calls CAPI with. When the
+// proxy runs in the same process, the requests are served by it directly
+// so that they share its GET cache.
+func (s *Sidecar) capiClient() *http.Client {
+	if s.proxy == nil {
+		return s.Client
+	}
+
+	return &http.Client{
+		Transport: handlerTransport{h: s.proxy},
+		Timeout:   s.Client.Timeout,
+	}
+}
+
+// handlerTransport serves requests with a handler instead of sending them.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, r)
+
+	return rec.Result(), nil
+}
+
+// NewServer returns a server with the configured timeouts.
+func (s *Sidecar) NewServer(addr string, h http.Handler) server.Server {
+	return server.Server{
+		Server: &http.Server{
+			Addr:              addr,
+			Handler:           h,
+			ReadHeaderTimeout: s.cfg.ServerReadHeaderTimeout,
+			ReadTimeout:       s.cfg.ServerReadTimeout,
+			WriteTimeout:      s.cfg.ServerWriteTimeout,
+			IdleTimeout:       s.cfg.ServerIdleTimeout,
+		},
+	}
+}
+
+// Serve serves the metrics (expvar and /metrics) and health endpoints on
+// the health port along with the given servers until SIGTERM. In-flight
+// requests are then given the grace period and the background goroutines
+// are stopped.
+func (s *Sidecar) Serve(healthPort int, grace time.Duration, servers ...server.Server) error {
+	namespace := "cf_space_security_" + strings.Replace(s.cfg.Name, "-", "_", -1)
+	http.Handle("/metrics", metrics.NewPrometheusHandler(namespace, s.expvarMap))
+	http.Handle("/health", s.Health.Liveness())
+	http.Handle("/ready", s.Health.Readiness())
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	s.Log.Infof("Listening on healthport %d", healthPort)
+	servers = append([]server.Server{s.NewServer(fmt.Sprintf(":%d", healthPort), nil)}, servers...)
+	err := server.Serve(sigCtx, grace, s.Log, servers...)
+
+	s.cancel()
+	s.wg.Wait()
+
+	return err
+}
@@ -0,0 +1,214 @@
+package sidecar_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/sidecar"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+// expvar maps can only be published once per name.
+var expvarNames int64
+
+type TS struct {
+	*testing.T
+	server *httptest.Server
+	cfg    sidecar.Config
+	log    logger.Logger
+}
+
+func TestSidecar(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TS {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		return TS{
+			T:      t,
+			server: server,
+			cfg: sidecar.Config{
+				Name:                    "some-name",
+				ExpvarName:              fmt.Sprintf("Sidecar%d", atomic.AddInt64(&expvarNames, 1)),
+				Client:                  http.DefaultClient,
+				CAPIAddr:                server.URL,
+				UAAAddr:                 server.URL,
+				HealthTimeout:           time.Second,
+				ServerReadHeaderTimeout: time.Second,
+				ServerIdleTimeout:       time.Minute,
+			},
+			log: logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		}
+	})
+
+	o.AfterEach(func(t TS) {
+		t.server.Close()
+	})
+
+	o.Spec("checks CAPI and UAA", func(t TS) {
+		s := sidecar.New(t.cfg, t.log)
+
+		recorder := httptest.NewRecorder()
+		s.Health.Readiness().ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var resp struct {
+			Checks map[string]interface{} `json:"checks"`
+		}
+		Expect(t, json.Unmarshal(recorder.Body.Bytes(), &resp)).To(BeNil())
+		Expect(t, resp.Checks).To(HaveLen(2))
+		Expect(t, resp.Checks).To(HaveKey("capi"))
+		Expect(t, resp.Checks).To(HaveKey("uaa"))
+	})
+
+	o.Spec("is not ready when CAPI and UAA are unreachable", func(t TS) {
+		s := sidecar.New(t.cfg, t.log)
+		t.server.Close()
+
+		recorder := httptest.NewRecorder()
+		s.Health.Readiness().ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+		Expect(t, recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	o.Spec("runs the proxy and reverse proxy together", func(t TS) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+		backendURL, err := url.Parse(backend.URL)
+		Expect(t, err).To(BeNil())
+
+		uaa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{
+				"access_token":  newToken(t.T),
+				"refresh_token": newToken(t.T),
+			})
+		}))
+		defer uaa.Close()
+
+		vcap := sidecar.VcapApplication{
+			CAPIAddr:      t.server.URL,
+			ApplicationID: "some-app",
+			SpaceID:       "some-space",
+		}
+		s := sidecar.New(t.cfg, t.log)
+
+		proxyServers := sidecar.NewProxy(sidecar.ProxyConfig{
+			CacheSize:        1,
+			CacheExpiration:  time.Minute,
+			VcapApplication:  vcap,
+			ClientID:         "some-client",
+			RefreshToken:     newToken(t.T),
+			RetryMaxAttempts: 1,
+			UAAAddr:          uaa.URL,
+		}, s)
+		reverseProxyServers := sidecar.NewReverseProxy(sidecar.ReverseProxyConfig{
+			BackendURL:           backend.URL,
+			Backend:              backendURL,
+			CAPIBreakerThreshold: 5,
+			CAPIBreakerCooldown:  time.Minute,
+			VcapApplication:      vcap,
+			UAAAddr:              uaa.URL,
+		}, s)
+
+		Expect(t, reverseProxyServers).To(HaveLen(1))
+		Expect(t, proxyServers).To(HaveLen(0))
+
+		recorder := httptest.NewRecorder()
+		reverseProxyServers[0].Handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		// The reverse proxy validates tokens through the proxy (which only
+		// calls CAPI via HTTPS).
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "bearer "+newToken(t.T))
+		recorder = httptest.NewRecorder()
+		reverseProxyServers[0].Handler.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusServiceUnavailable))
+
+		capiURL, err := url.Parse(t.server.URL)
+		Expect(t, err).To(BeNil())
+		requests := expvar.Get(t.cfg.ExpvarName).(*expvar.Map).Get("Requests").(*expvar.Map)
+		Expect(t, requests.Get("host="+capiURL.Host+",status_class=5xx").String()).To(Equal("1"))
+
+		recorder = httptest.NewRecorder()
+		s.Health.Readiness().ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+		var resp struct {
+			Checks map[string]interface{} `json:"checks"`
+		}
+		Expect(t, json.Unmarshal(recorder.Body.Bytes(), &resp)).To(BeNil())
+		for _, name := range []string{"capi", "uaa", "backend", "validation", "access_token", "refresh_token", "cache"} {
+			Expect(t, resp.Checks).To(HaveKey(name))
+		}
+	})
+
+	o.Spec("calls CAPI directly when the proxy skips SSL validation", func(t TS) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+		backendURL, err := url.Parse(backend.URL)
+		Expect(t, err).To(BeNil())
+
+		vcap := sidecar.VcapApplication{
+			CAPIAddr:      t.server.URL,
+			ApplicationID: "some-app",
+		}
+		s := sidecar.New(t.cfg, t.log)
+
+		sidecar.NewProxy(sidecar.ProxyConfig{
+			VcapApplication:   vcap,
+			ClientID:          "some-client",
+			RefreshToken:      newToken(t.T),
+			SkipSSLValidation: true,
+			RetryMaxAttempts:  1,
+			UAAAddr:           t.server.URL,
+		}, s)
+		servers := sidecar.NewReverseProxy(sidecar.ReverseProxyConfig{
+			BackendURL:           backend.URL,
+			Backend:              backendURL,
+			CAPIBreakerThreshold: 5,
+			CAPIBreakerCooldown:  time.Minute,
+			VcapApplication:      vcap,
+			UAAAddr:              t.server.URL,
+		}, s)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "bearer "+newToken(t.T))
+		recorder := httptest.NewRecorder()
+		servers[0].Handler.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("creates servers with the configured timeouts", func(t TS) {
+		s := sidecar.New(t.cfg, t.log)
+
+		srv := s.NewServer(":8080", http.NotFoundHandler())
+		Expect(t, srv.Addr).To(Equal(":8080"))
+		Expect(t, srv.ReadHeaderTimeout).To(Equal(time.Second))
+		Expect(t, srv.IdleTimeout).To(Equal(time.Minute))
+		Expect(t, srv.Listener).To(BeNil())
+	})
+}
+
+func newToken(t *testing.T) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("some-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
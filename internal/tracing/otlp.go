@@ -0,0 +1,237 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/logger"
+)
+
+// maxBufferedSpans is the number of spans that are held between flushes.
+// Spans beyond that are dropped.
+const maxBufferedSpans = 2048
+
+// Doer is used to make HTTP requests.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// OTLPExporter batches spans and sends them to an OpenTelemetry collector via
+// OTLP/HTTP (JSON encoded).
+type OTLPExporter struct {
+	addr        string
+	serviceName string
+	d           Doer
+	log         logger.Logger
+
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewOTLPExporter returns a new OTLPExporter. The addr is the base URL of the
+// collector (e.g., http://localhost:4318). Spans are sent to /v1/traces.
+func NewOTLPExporter(addr, serviceName string, d Doer, log logger.Logger) *OTLPExporter {
+	return &OTLPExporter{
+		addr:        strings.TrimRight(addr, "/"),
+		serviceName: serviceName,
+		d:           d,
+		log:         log,
+	}
+}
+
+// Export implements Exporter.
+func (e *OTLPExporter) Export(s SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.spans) >= maxBufferedSpans {
+		e.log.Debugf("dropping span %s: buffer is full", s.Name)
+		return
+	}
+
+	e.spans = append(e.spans, s)
+}
+
+// Run flushes the spans every interval until the context is done. The
+// remaining spans are then flushed.
+func (e *OTLPExporter) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.Flush()
+		case <-ctx.Done():
+			e.Flush()
+			return
+		}
+	}
+}
+
+// Flush sends the buffered spans to the collector.
+func (e *OTLPExporter) Flush() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(e.request(spans))
+	if err != nil {
+		e.log.Panicf("failed to marshal spans: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.addr+"/v1/traces", bytes.NewReader(data))
+	if err != nil {
+		e.log.Errorf("failed to create OTLP request: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.d.Do(req)
+	if err != nil {
+		e.log.Errorf("failed to send spans to collector (%s): %s", e.addr, err)
+		return
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e.log.Errorf("failed to send spans to collector (%s): %d", e.addr, resp.StatusCode)
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	// 0 is unset, 2 is error
+	Code int `json:"code"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *OTLPExporter) request(spans []SpanData) otlpRequest {
+	var otlpSpans []otlpSpan
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.SpanContext.TraceIDString(),
+			SpanID:            s.SpanContext.SpanIDString(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attributes),
+		}
+
+		if s.ParentSpanID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+
+		if s.Error {
+			span.Status.Code = 2
+		}
+
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: attributes(map[string]interface{}{
+						"service.name": e.serviceName,
+					}),
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "cf-space-security"},
+						Spans: otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func attributes(m map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var kvs []otlpKeyValue
+	for _, k := range keys {
+		var v map[string]interface{}
+		switch x := m[k].(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": x}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": x}
+		case string:
+			v = map[string]interface{}{"stringValue": x}
+		default:
+			continue
+		}
+
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: v})
+	}
+
+	return kvs
+}
@@ -0,0 +1,172 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/poy/cf-space-security/internal/logger"
+	"github.com/poy/cf-space-security/internal/tracing"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TO struct {
+	*testing.T
+	collector *fakeCollector
+	e         *tracing.OTLPExporter
+	tracer    *tracing.Tracer
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TO {
+		collector := newFakeCollector()
+		server := httptest.NewServer(collector)
+		e := tracing.NewOTLPExporter(
+			server.URL,
+			"some-service",
+			http.DefaultClient,
+			logger.New(ioutil.Discard, "", logger.Debug, logger.Text),
+		)
+
+		return TO{
+			T:         t,
+			collector: collector,
+			e:         e,
+			tracer:    tracing.NewTracer(e),
+		}
+	})
+
+	o.Spec("sends spans with their parents", func(t TO) {
+		ctx, parent := t.tracer.StartSpan(context.Background(), "some-parent", tracing.Server)
+		_, child := t.tracer.StartSpan(ctx, "some-child", tracing.Client)
+		child.SetAttribute("some-key", "some-value")
+		child.SetError()
+		child.End()
+		parent.End()
+		t.e.Flush()
+
+		spans := t.collector.getSpans()
+		Expect(t, spans).To(HaveLen(2))
+
+		Expect(t, spans[0]["name"]).To(Equal("some-child"))
+		Expect(t, spans[0]["kind"]).To(Equal(float64(3)))
+		Expect(t, spans[0]["traceId"]).To(Equal(parent.SpanContext().TraceIDString()))
+		Expect(t, spans[0]["parentSpanId"]).To(Equal(parent.SpanContext().SpanIDString()))
+		Expect(t, spans[0]["status"]).To(Equal(map[string]interface{}{"code": float64(2)}))
+		Expect(t, spans[0]["attributes"]).To(Equal([]interface{}{
+			map[string]interface{}{
+				"key":   "some-key",
+				"value": map[string]interface{}{"stringValue": "some-value"},
+			},
+		}))
+
+		Expect(t, spans[1]["name"]).To(Equal("some-parent"))
+		_, hasParent := spans[1]["parentSpanId"]
+		Expect(t, hasParent).To(BeFalse())
+		Expect(t, t.collector.getServiceName()).To(Equal("some-service"))
+	})
+
+	o.Spec("continues a remote trace", func(t TO) {
+		h := http.Header{}
+		h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		req, err := http.NewRequest(http.MethodGet, "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header = h
+
+		_, s := t.tracer.StartSpan(tracing.FromRequest(req), "some-span", tracing.Server)
+		s.End()
+		t.e.Flush()
+
+		spans := t.collector.getSpans()
+		Expect(t, spans).To(HaveLen(1))
+		Expect(t, spans[0]["traceId"]).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(t, spans[0]["parentSpanId"]).To(Equal("00f067aa0ba902b7"))
+	})
+
+	o.Spec("does not send unsampled spans", func(t TO) {
+		h := http.Header{}
+		h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		req, err := http.NewRequest(http.MethodGet, "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		req.Header = h
+
+		_, s := t.tracer.StartSpan(tracing.FromRequest(req), "some-span", tracing.Server)
+		s.End()
+		t.e.Flush()
+
+		Expect(t, t.collector.getSpans()).To(HaveLen(0))
+	})
+}
+
+type fakeCollector struct {
+	mu          sync.Mutex
+	spans       []map[string]interface{}
+	serviceName string
+}
+
+func newFakeCollector() *fakeCollector {
+	return &fakeCollector{}
+}
+
+func (f *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, a := range rs.Resource.Attributes {
+			if a.Key == "service.name" {
+				f.serviceName = a.Value.StringValue
+			}
+		}
+
+		for _, ss := range rs.ScopeSpans {
+			f.spans = append(f.spans, ss.Spans...)
+		}
+	}
+}
+
+func (f *fakeCollector) getSpans() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.spans
+}
+
+func (f *fakeCollector) getServiceName() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.serviceName
+}
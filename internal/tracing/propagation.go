@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the hex encoded trace ID.
+func (c SpanContext) TraceIDString() string {
+	return hex.EncodeToString(c.TraceID[:])
+}
+
+// SpanIDString returns the hex encoded span ID.
+func (c SpanContext) SpanIDString() string {
+	return hex.EncodeToString(c.SpanID[:])
+}
+
+// Headers that carry trace context. They are removed and re-written with
+// each hop.
+var Headers = []string{
+	"Traceparent",
+	"Tracestate",
+	"B3",
+	"X-B3-Traceid",
+	"X-B3-Spanid",
+	"X-B3-Parentspanid",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// Extract reads the trace context from the W3C traceparent header. If it is
+// not present, it falls back to the B3 headers (single or multi).
+func Extract(h http.Header) (SpanContext, bool) {
+	if c, ok := parseTraceparent(h.Get("Traceparent")); ok {
+		return c, true
+	}
+
+	if c, ok := parseB3Single(h.Get("B3")); ok {
+		return c, true
+	}
+
+	return parseB3Multi(h)
+}
+
+// Inject writes the trace context as both W3C traceparent and B3 headers.
+// Any existing trace headers (except tracestate) are replaced.
+func Inject(c SpanContext, h http.Header) {
+	for _, name := range Headers {
+		if name == "Tracestate" {
+			continue
+		}
+		h.Del(name)
+	}
+
+	flags := "00"
+	sampled := "0"
+	if c.Sampled {
+		flags = "01"
+		sampled = "1"
+	}
+
+	h.Set("Traceparent", fmt.Sprintf("00-%s-%s-%s", c.TraceIDString(), c.SpanIDString(), flags))
+	h.Set("X-B3-Traceid", c.TraceIDString())
+	h.Set("X-B3-Spanid", c.SpanIDString())
+	h.Set("X-B3-Sampled", sampled)
+}
+
+func parseTraceparent(v string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+
+	var c SpanContext
+	if !decodeHex(c.TraceID[:], parts[1]) || !decodeHex(c.SpanID[:], parts[2]) {
+		return SpanContext{}, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return SpanContext{}, false
+	}
+	c.Sampled = flags[0]&1 == 1
+
+	return c, c.IsValid()
+}
+
+func parseB3Single(v string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 2 {
+		return SpanContext{}, false
+	}
+
+	c, ok := parseB3IDs(parts[0], parts[1])
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	c.Sampled = true
+	if len(parts) > 2 {
+		c.Sampled = parts[2] == "1" || parts[2] == "d"
+	}
+
+	return c, true
+}
+
+func parseB3Multi(h http.Header) (SpanContext, bool) {
+	c, ok := parseB3IDs(h.Get("X-B3-Traceid"), h.Get("X-B3-Spanid"))
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	c.Sampled = h.Get("X-B3-Sampled") != "0" || h.Get("X-B3-Flags") == "1"
+	return c, true
+}
+
+func parseB3IDs(traceID, spanID string) (SpanContext, bool) {
+	// 64 bit trace IDs are left padded.
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+
+	var c SpanContext
+	if !decodeHex(c.TraceID[:], traceID) || !decodeHex(c.SpanID[:], spanID) {
+		return SpanContext{}, false
+	}
+
+	return c, c.IsValid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
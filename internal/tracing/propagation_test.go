@@ -0,0 +1,78 @@
+package tracing_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/poy/cf-space-security/internal/tracing"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestPropagation(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("extracts W3C traceparent", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		c, ok := tracing.Extract(h)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, c.TraceIDString()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(t, c.SpanIDString()).To(Equal("00f067aa0ba902b7"))
+		Expect(t, c.Sampled).To(BeTrue())
+	})
+
+	o.Spec("extracts single B3 header", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("b3", "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0")
+
+		c, ok := tracing.Extract(h)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, c.TraceIDString()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(t, c.Sampled).To(BeFalse())
+	})
+
+	o.Spec("extracts multi B3 headers with 64 bit trace IDs", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("X-B3-TraceId", "a3ce929d0e0e4736")
+		h.Set("X-B3-SpanId", "00f067aa0ba902b7")
+		h.Set("X-B3-Sampled", "1")
+
+		c, ok := tracing.Extract(h)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, c.TraceIDString()).To(Equal("0000000000000000a3ce929d0e0e4736"))
+		Expect(t, c.SpanIDString()).To(Equal("00f067aa0ba902b7"))
+		Expect(t, c.Sampled).To(BeTrue())
+	})
+
+	o.Spec("ignores invalid headers", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+		_, ok := tracing.Extract(h)
+		Expect(t, ok).To(BeFalse())
+
+		h.Set("traceparent", "invalid")
+		_, ok = tracing.Extract(h)
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("injects W3C and B3 headers", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("b3", "some-old-value")
+
+		c, _ := tracing.Extract(http.Header{
+			"Traceparent": []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		})
+		tracing.Inject(c, h)
+
+		Expect(t, h.Get("traceparent")).To(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+		Expect(t, h.Get("X-B3-TraceId")).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(t, h.Get("X-B3-SpanId")).To(Equal("00f067aa0ba902b7"))
+		Expect(t, h.Get("X-B3-Sampled")).To(Equal("1"))
+		Expect(t, h.Get("b3")).To(Equal(""))
+	})
+}
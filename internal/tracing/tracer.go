@@ -0,0 +1,164 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SpanKind describes the relationship of the span to the rest of the trace.
+// The values line up with OTLP.
+type SpanKind int
+
+const (
+	Internal SpanKind = 1
+	Server   SpanKind = 2
+	Client   SpanKind = 3
+)
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(SpanData)
+}
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	Error        bool
+}
+
+// Tracer creates spans. Spans are only exported when they are sampled and
+// the Tracer has an Exporter. Trace context is propagated either way.
+type Tracer struct {
+	e Exporter
+}
+
+// NewTracer returns a new Tracer. The Exporter may be nil.
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{
+		e: e,
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithRemote returns a context that new spans will use as their
+// parent when there isn't already a span in the context.
+func ContextWithRemote(ctx context.Context, c SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, c)
+}
+
+// FromRequest returns the request's context with the trace context from
+// its headers (if any).
+func FromRequest(r *http.Request) context.Context {
+	if c, ok := Extract(r.Header); ok {
+		return ContextWithRemote(r.Context(), c)
+	}
+
+	return r.Context()
+}
+
+// SpanFromContext returns the current span or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartSpan starts a span that is a child of the span (or remote span
+// context) in the given context. The returned context holds the new span.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if s := SpanFromContext(ctx); s != nil {
+		parent = s.SpanContext()
+	} else if c, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = c
+	}
+
+	sc := SpanContext{
+		TraceID: parent.TraceID,
+		Sampled: parent.Sampled,
+	}
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+		sc.Sampled = t.e != nil
+	}
+	rand.Read(sc.SpanID[:])
+
+	s := &Span{
+		t: t,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			SpanContext:  sc,
+			ParentSpanID: parent.SpanID,
+			Start:        time.Now(),
+			Attributes:   make(map[string]interface{}),
+		},
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Span is an in-flight operation.
+type Span struct {
+	t *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the span's trace and span IDs.
+func (s *Span) SpanContext() SpanContext {
+	return s.data.SpanContext
+}
+
+// SetAttribute sets an attribute on the span. Values should be strings,
+// bools, ints or float64s.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = true
+}
+
+// End finishes the span and exports it if it is sampled. Only the first call
+// has any effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+
+	attrs := make(map[string]interface{}, len(s.data.Attributes))
+	for k, v := range s.data.Attributes {
+		attrs[k] = v
+	}
+	data := s.data
+	data.Attributes = attrs
+	s.mu.Unlock()
+
+	if s.t.e == nil || !data.SpanContext.Sampled {
+		return
+	}
+
+	s.t.e.Export(data)
+}
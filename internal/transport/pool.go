@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Config tunes the transports of a Pool.
+type Config struct {
+	SkipSSLValidation bool
+
+	// Requests are sent via the proxy of HTTP_PROXY/HTTPS_PROXY unless
+	// IgnoreProxyEnv is set (e.g., for the proxy's own upstream requests).
+	IgnoreProxyEnv bool
+
+	// RootCAs verify the servers' certificates. The host's CAs are used
+	// when nil.
+	RootCAs *x509.CertPool
+
+	// UnixSocket is dialed for every connection, regardless of the
+	// request's host.
+	UnixSocket string
+
+	// MaxIdleConnsPerHost is the number of keep-alive connections kept for
+	// each host. MaxConnsPerHost (0 is unlimited) caps all connections.
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	IdleConnTimeout       time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// Timeout limits how long a Pool's request (including reading the
+	// response body) may take. Upgrade requests (e.g., websockets) are not
+	// limited. 0 is no limit.
+	Timeout time.Duration
+
+	HTTP2 bool
+}
+
+// Pool is a RoundTripper that keeps a transport (and therefore a pool of
+// connections) for each upstream host.
+type Pool struct {
+	cfg Config
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func NewPool(cfg Config) *Pool {
+	return &Pool{
+		cfg:        cfg,
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+func (p *Pool) RoundTrip(r *http.Request) (*http.Response, error) {
+	t := p.transport(r.URL.Host)
+	if p.cfg.Timeout <= 0 || r.Header.Get("Upgrade") != "" {
+		return t.RoundTrip(r)
+	}
+
+	// The deadline covers the body, so it is only canceled once the body
+	// is closed.
+	ctx, cancel := context.WithTimeout(r.Context(), p.cfg.Timeout)
+	resp, err := t.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelCloser struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// CloseIdleConnections closes the idle connections of every host.
+func (p *Pool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+func (p *Pool) transport(host string) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.transports[host]; ok {
+		return t
+	}
+
+	t := New(p.cfg)
+	p.transports[host] = t
+
+	return t
+}
+
+// New returns a transport configured by cfg.
+func New(cfg Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	dial := dialer.DialContext
+	if cfg.UnixSocket != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", cfg.UnixSocket)
+		}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.IgnoreProxyEnv {
+		proxy = nil
+	}
+
+	return &http.Transport{
+		Proxy:       proxy,
+		DialContext: dial,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: cfg.SkipSSLValidation,
+			RootCAs:            cfg.RootCAs,
+		},
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+	}
+}
+
+// NewClient returns a client with a transport configured by cfg. Requests
+// (including reading the response body) time out after timeout.
+func NewClient(cfg Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: New(cfg),
+	}
+}
@@ -0,0 +1,185 @@
+package transport_test
+
+import (
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-space-security/internal/transport"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TP struct {
+	*testing.T
+	p      *transport.Pool
+	server *httptest.Server
+
+	mu    sync.Mutex
+	conns int
+}
+
+func TestPool(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) *TP {
+		tp := &TP{
+			T: t,
+			p: transport.NewPool(transport.Config{
+				SkipSSLValidation:   true,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     time.Minute,
+			}),
+		}
+
+		tp.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("some-data"))
+		}))
+		tp.server.Config.ConnState = func(c net.Conn, s http.ConnState) {
+			if s == http.StateNew {
+				tp.mu.Lock()
+				defer tp.mu.Unlock()
+				tp.conns++
+			}
+		}
+		tp.server.StartTLS()
+
+		return tp
+	})
+
+	o.AfterEach(func(t *TP) {
+		t.p.CloseIdleConnections()
+		t.server.Close()
+	})
+
+	o.Spec("reuses connections to the same host", func(t *TP) {
+		for i := 0; i < 5; i++ {
+			req, err := http.NewRequest("GET", t.server.URL, nil)
+			Expect(t, err).To(BeNil())
+
+			resp, err := t.p.RoundTrip(req)
+			Expect(t, err).To(BeNil())
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		Expect(t, t.conns).To(Equal(1))
+	})
+
+	o.Spec("uses HTTP/2 when enabled", func(t *TP) {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		defer server.Close()
+
+		p := transport.NewPool(transport.Config{
+			SkipSSLValidation: true,
+			HTTP2:             true,
+		})
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		Expect(t, err).To(BeNil())
+
+		resp, err := p.RoundTrip(req)
+		Expect(t, err).To(BeNil())
+		resp.Body.Close()
+		Expect(t, resp.ProtoMajor).To(Equal(2))
+	})
+
+	o.Spec("times out slow response bodies", func(t *TP) {
+		done := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		}))
+		defer server.Close()
+		defer close(done)
+
+		p := transport.NewPool(transport.Config{Timeout: 50 * time.Millisecond})
+		req, err := http.NewRequest("GET", server.URL, nil)
+		Expect(t, err).To(BeNil())
+
+		resp, err := p.RoundTrip(req)
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+
+		start := time.Now()
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, time.Since(start) < time.Second).To(BeTrue())
+	})
+
+	o.Spec("uses the proxy from the environment unless told not to", func(t *TP) {
+		Expect(t, transport.New(transport.Config{}).Proxy).To(Not(BeNil()))
+		Expect(t, transport.New(transport.Config{IgnoreProxyEnv: true}).Proxy).To(BeNil())
+	})
+
+	o.Spec("client times out slow responses", func(t *TP) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}))
+		defer server.Close()
+
+		c := transport.NewClient(transport.Config{}, 10*time.Millisecond)
+		_, err := c.Get(server.URL)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("verifies servers with the given CAs", func(t *TP) {
+		req, err := http.NewRequest("GET", t.server.URL, nil)
+		Expect(t, err).To(BeNil())
+
+		_, err = transport.New(transport.Config{}).RoundTrip(req)
+		Expect(t, err).To(Not(BeNil()))
+
+		pool := x509.NewCertPool()
+		pool.AddCert(t.server.Certificate())
+		resp, err := transport.New(transport.Config{RootCAs: pool}).RoundTrip(req)
+		Expect(t, err).To(BeNil())
+		resp.Body.Close()
+	})
+
+	o.Spec("dials the Unix socket", func(t *TP) {
+		dir, err := ioutil.TempDir("", "transport")
+		Expect(t, err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		l, err := net.Listen("unix", filepath.Join(dir, "app.sock"))
+		Expect(t, err).To(BeNil())
+		server := &httptest.Server{
+			Listener: l,
+			Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Host))
+			})},
+		}
+		server.Start()
+		defer server.Close()
+
+		resp, err := transport.NewClient(transport.Config{
+			UnixSocket: filepath.Join(dir, "app.sock"),
+		}, time.Second).Get("http://some-host/")
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(body)).To(Equal("some-host"))
+	})
+}